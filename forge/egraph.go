@@ -0,0 +1,787 @@
+package forge
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+EGraph is an e-graph, a compact representation of many expressions equivalent
+to the outputs of a graph, used to optimize a graph by equality saturation.
+
+Expressions are represented by e-nodes grouped into equivalence classes, the
+operands of an e-node are classes instead of nodes. Rewrite rules add the
+expressions they derive to the class of the matched e-node without removing
+anything, so the result doesn't depend on the order rules are applied in. When
+no rule adds anything new, or the e-graph grows beyond a budget, the cheapest
+expression of each output is extracted back into the graph.
+
+See "egg: Fast and Extensible Equality Saturation, POPL 2021".
+*/
+type EGraph struct {
+	// Union-find of class ids, a class is canonical if it's its own parent
+	parents []eClassId
+	classes map[eClassId]*eClass
+	// Canonical e-nodes and their class
+	hashcons map[string]eClassId
+
+	outputs []eOutput
+}
+
+/*
+eClassId identifies a class of an e-graph.
+*/
+type eClassId int
+
+/*
+eNode is an operation whose operands are classes, or a leaf for an input or a
+constant. A negation is a NodeOp_Sub with a single operand, the same way the
+parser represents it, so signs on edges become e-nodes.
+*/
+type eNode struct {
+	op       NodeOp
+	children []eClassId
+
+	input    *Node
+	constant bool
+	value    float64
+
+	// The graph node this e-node is imported from, reused when it's extracted
+	origin *Node
+}
+
+/*
+eClass is an equivalence class of e-nodes.
+*/
+type eClass struct {
+	nodes []*eNode
+
+	// Whether the class is known to be a constant, and its value
+	constant bool
+	value    float64
+}
+
+/*
+eOutput records the class of an output node.
+*/
+type eOutput struct {
+	node  *Node
+	class eClassId
+}
+
+/*
+eRule is a rewrite rule. It returns classes equivalent to the class of an
+e-node, adding the expressions it derives to the e-graph.
+*/
+type eRule struct {
+	name  string
+	apply func(eg *EGraph, n *eNode) []eClassId
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+CreateEGraph creates and returns a pointer to an empty e-graph.
+*/
+func CreateEGraph() *EGraph {
+	eg := &EGraph{}
+
+	eg.classes = make(map[eClassId]*eClass)
+	eg.hashcons = make(map[string]eClassId)
+
+	return eg
+}
+
+func (eg *EGraph) NumClasses() int { return len(eg.classes) }
+func (eg *EGraph) NumNodes() int   { return len(eg.hashcons) }
+
+/*
+Import adds the transitive fanin cones of all output nodes of a graph.
+*/
+func (eg *EGraph) Import(g *Graph) {
+	classes := make(map[*Node]eClassId)
+
+	for _, node := range g.TopologicalOrder() {
+		switch node.kind {
+		case NodeKind_Input:
+			classes[node] = eg.add(&eNode{input: node, origin: node})
+		case NodeKind_Constant:
+			classes[node] = eg.addConstant(node.value)
+		case NodeKind_Operation:
+			n := &eNode{op: node.op, origin: node}
+			for i, fi := range node.fanins {
+				n.children = append(n.children, eg.signed(classes[fi], node.GetFaninSignByIndex(i)))
+			}
+			classes[node] = eg.add(n)
+		case NodeKind_Output:
+			if node.NumFanins() == 1 {
+				class := eg.signed(classes[node.Fanin(0)], node.GetFaninSignByIndex(0))
+				eg.outputs = append(eg.outputs, eOutput{node, class})
+			}
+		}
+	}
+}
+
+/*
+Saturate applies the rules repeatedly until none of them adds anything new, the
+number of e-nodes exceeds nodeBudget, or maxIterations is reached. The number of
+iterations is returned.
+*/
+func (eg *EGraph) Saturate(nodeBudget, maxIterations int) int {
+	iteration := 0
+
+	for ; iteration < maxIterations && eg.NumNodes() < nodeBudget; iteration++ {
+		numNodes, numClasses := eg.NumNodes(), eg.NumClasses()
+
+		// Match rules against a snapshot of the e-nodes, so that e-nodes added
+		// by rules are matched in the next iteration
+		type match struct{ a, b eClassId }
+		matches := []match{}
+
+	search:
+		for _, id := range eg.sortedClassIds() {
+			// The class may be merged by constant folding of an added e-node, and
+			// nothing is cheaper than a constant
+			class := eg.classes[eg.find(id)]
+			if class.constant {
+				continue
+			}
+
+			for _, n := range class.nodes {
+				for _, rule := range eRules {
+					for _, equivalent := range rule.apply(eg, n) {
+						matches = append(matches, match{id, equivalent})
+					}
+
+					if eg.NumNodes() >= nodeBudget {
+						break search
+					}
+				}
+			}
+		}
+
+		for _, m := range matches {
+			eg.union(m.a, m.b)
+		}
+		eg.rebuild()
+
+		if eg.NumNodes() == numNodes && eg.NumClasses() == numClasses {
+			break
+		}
+	}
+
+	return iteration
+}
+
+/*
+Extract replaces the fanin cone of every output node in the graph by the
+cheapest expression of its class, and returns true if the graph is changed.
+
+The cost of an expression is the sum of the costs of its operations, see
+eOpCosts() and ePowerCost(). Expressions are compared by their cost as trees,
+and the graph is changed only if the extracted expressions cost less than the
+fanin cones of the outputs in the graph, both counting common subexpressions
+once.
+*/
+func (eg *EGraph) Extract(g *Graph, processor *Processor) bool {
+	opCosts := eOpCosts(processor)
+
+	// Costs of powers by their exponent, finding addition chains isn't free
+	powerCosts := make(map[float64]float64)
+	powerCost := func(exponent float64, constant bool) float64 {
+		if !constant {
+			return opCosts[NodeOp_Power]
+		}
+		cost, exist := powerCosts[exponent]
+		if !exist {
+			cost = ePowerCost(exponent, opCosts)
+			powerCosts[exponent] = cost
+		}
+		return cost
+	}
+
+	nodeCost := func(n *eNode) float64 {
+		if n.input != nil || n.constant {
+			return 0
+		}
+		if n.op == NodeOp_Power {
+			return powerCost(eg.constantOf(n.children[1]))
+		}
+		return opCosts[n.op]
+	}
+
+	// Find the cheapest e-node of each class, costs only decrease so this
+	// reaches a fixed point
+	ids := eg.sortedClassIds()
+	bestCosts := make(map[eClassId]float64)
+	bestNodes := make(map[eClassId]*eNode)
+
+	for changed := true; changed; {
+		changed = false
+
+		for _, id := range ids {
+			for _, n := range eg.classes[id].nodes {
+				cost := nodeCost(n)
+				for _, child := range n.children {
+					childCost, exist := bestCosts[eg.find(child)]
+					if !exist {
+						cost = math.Inf(1)
+						break
+					}
+					cost += childCost
+				}
+
+				if math.IsInf(cost, 1) {
+					continue
+				}
+
+				// Prefer e-nodes imported from the graph among the cheapest ones, so
+				// that unchanged parts of the graph are kept
+				best, exist := bestCosts[id]
+				if !exist || cost < best {
+					bestCosts[id], bestNodes[id] = cost, n
+					changed = true
+				} else if cost == best && n.origin != nil && bestNodes[id].origin == nil {
+					bestNodes[id] = n
+				}
+			}
+		}
+	}
+
+	// Compare the cost of the extracted expressions against the graph
+	extractedCost := 0.0
+	visited := make(map[eClassId]bool)
+
+	var visit func(id eClassId)
+	visit = func(id eClassId) {
+		id = eg.find(id)
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+
+		extractedCost += nodeCost(bestNodes[id])
+		for _, child := range bestNodes[id].children {
+			visit(child)
+		}
+	}
+	for _, output := range eg.outputs {
+		if _, exist := bestNodes[eg.find(output.class)]; !exist {
+			return false
+		}
+		visit(output.class)
+	}
+
+	// The graph is priced the same way over the fanin cones of the outputs, so
+	// dead operations don't count. A negated edge is a negation e-node, which is
+	// shared by all edges from the same node.
+	graphCost := 0.0
+	inCone := make(map[*Node]bool)
+	negated := make(map[*Node]bool)
+
+	stack := []*Node{}
+	for _, output := range eg.outputs {
+		stack = append(stack, output.node)
+	}
+
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if inCone[node] {
+			continue
+		}
+		inCone[node] = true
+		stack = append(stack, node.fanins...)
+
+		switch {
+		case node.kind != NodeKind_Operation:
+		case node.op == NodeOp_Power:
+			exponent := node.Fanin(1)
+			value := exponent.value
+			if node.GetFaninSignByIndex(1) {
+				value = -value
+			}
+			graphCost += powerCost(value, exponent.kind == NodeKind_Constant)
+		default:
+			graphCost += opCosts[node.op]
+		}
+
+		// Negated constants are constants in the e-graph
+		for i, fi := range node.fanins {
+			if node.GetFaninSignByIndex(i) && fi.kind != NodeKind_Constant && !negated[fi] {
+				negated[fi] = true
+				graphCost += opCosts[NodeOp_Sub]
+			}
+		}
+	}
+
+	if extractedCost >= graphCost {
+		return false
+	}
+
+	// Build the extracted expressions, a class is built once and shared
+	type result struct {
+		node   *Node
+		negate bool
+	}
+	built := make(map[eClassId]result)
+
+	var build func(id eClassId) result
+	build = func(id eClassId) result {
+		id = eg.find(id)
+		if r, exist := built[id]; exist {
+			return r
+		}
+
+		var r result
+		n := bestNodes[id]
+
+		switch {
+		case n.input != nil:
+			r = result{n.input, false}
+		case n.constant:
+			r = result{g.GetConstantNode(math.Abs(n.value)), n.value < 0}
+		case n.op == NodeOp_Sub:
+			r = build(n.children[0])
+			r.negate = !r.negate
+		default:
+			operands := make([]result, len(n.children))
+			for i, child := range n.children {
+				operands[i] = build(child)
+			}
+
+			// Reuse the original node if its fanins are the same
+			reuse := n.origin != nil && g.allNodes[n.origin.name] == n.origin &&
+				n.origin.NumFanins() == len(operands)
+			for i := 0; reuse && i < len(operands); i++ {
+				reuse = n.origin.Fanin(i) == operands[i].node &&
+					n.origin.GetFaninSignByIndex(i) == operands[i].negate
+			}
+
+			if reuse {
+				r = result{n.origin, false}
+			} else {
+				node := g.addOperationNode(n.op)
+				for i, operand := range operands {
+					node.Receive(operand.node)
+					if operand.negate {
+						node.NegateFaninByIndex(i)
+					}
+				}
+				r = result{node, false}
+			}
+		}
+
+		built[id] = r
+		return r
+	}
+
+	// Build all outputs before deleting anything, so that original nodes used by
+	// any output can be reused
+	results := make([]result, len(eg.outputs))
+	for i, output := range eg.outputs {
+		results[i] = build(output.class)
+	}
+
+	oldNodes := []*Node{}
+	for i, output := range eg.outputs {
+		r := results[i]
+
+		oldNode := output.node.Fanin(0)
+		if oldNode == r.node && output.node.GetFaninSignByIndex(0) == r.negate {
+			continue
+		}
+
+		oldNode.RemoveFanout(output.node)
+		output.node.ReplaceFanin(oldNode, r.node)
+		r.node.AddFanout(output.node)
+		if output.node.GetFaninSignByIndex(0) != r.negate {
+			output.node.NegateFaninByIndex(0)
+		}
+
+		oldNodes = append(oldNodes, oldNode)
+	}
+
+	for _, node := range oldNodes {
+		g.deleteUnusedOperations(node)
+	}
+
+	g.isLevelized = false
+
+	return true
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+OptimizeByEGraph rewrites the graph by equality saturation, and returns the
+number of operation nodes saved.
+
+The graph is imported into an e-graph, rules for commutativity, associativity,
+distributivity, power laws, trigonometric identities and signs are applied until
+saturation or until the e-graph has nodeBudget e-nodes, and the cheapest
+equivalent graph is extracted using a cost model built from the process element
+counts and latencies of the processor.
+*/
+func (g *Graph) OptimizeByEGraph(processor *Processor, nodeBudget int) int {
+	numOperations := g.NumOperationNodes()
+
+	eg := CreateEGraph()
+	eg.Import(g)
+	eg.Saturate(nodeBudget, maxEGraphIterations)
+
+	if !eg.Extract(g, processor) || g.NumOperationNodes() > numOperations {
+		return 0
+	}
+
+	return numOperations - g.NumOperationNodes()
+}
+
+/*
+DefaultEGraphNodeBudget is the default maximum number of e-nodes, associativity
+and commutativity make the e-graph grow exponentially so saturation is usually
+stopped by the budget.
+*/
+const DefaultEGraphNodeBudget = 20000
+
+// maxEGraphIterations bounds the number of saturation iterations, each applying
+// every rule to every e-node once
+const maxEGraphIterations = 16
+
+/*
+eOpCosts returns the cost of each operation, the latency of the operation times
+how scarce its process elements are compared to the most common process
+element. Operations not supported by the processor are given a prohibitive cost,
+negations are nearly free since adders absorb them, and selecting an output of a
+sincos operation is free.
+*/
+func eOpCosts(processor *Processor) map[NodeOp]float64 {
+	counts := make(map[NodeOp]int)
+	maxCount := 1
+
+	for op := range NodeOpStringLUT {
+		for pgId := range processor.processGroups {
+			if pgId < len(compatibleMap[op]) {
+				counts[op] += len(compatibleMap[op][pgId])
+			}
+		}
+
+		if counts[op] > maxCount {
+			maxCount = counts[op]
+		}
+	}
+
+	costs := make(map[NodeOp]float64)
+	for op := range NodeOpStringLUT {
+		latency := nodeOpLatency[op]
+		if latency == 0 {
+			latency = 1
+		}
+
+		if counts[op] == 0 {
+			costs[op] = eUnsupportedCost
+		} else {
+			costs[op] = float64(latency) * float64(maxCount) / float64(counts[op])
+		}
+	}
+
+	costs[NodeOp_Sub] = eNegationCost
+	costs[NodeOp_SinCosSin] = 0
+	costs[NodeOp_SinCosCos] = 0
+
+	return costs
+}
+
+const (
+	eUnsupportedCost = 1e6
+	eNegationCost    = 0.125
+)
+
+/*
+ePowerCost returns the cost of a power with a constant exponent, which is the
+cost of the operations ReducePower() replaces it with: the multiplications of
+the addition chain of an integer exponent and a division for a negative one, or
+a square root for 0.5 and -0.5. Other exponents cost a power operation.
+*/
+func ePowerCost(exponent float64, opCosts map[NodeOp]float64) float64 {
+	switch {
+	case exponent == 0.5:
+		return opCosts[NodeOp_Sqrt]
+	case exponent == -0.5:
+		return opCosts[NodeOp_Sqrt] + opCosts[NodeOp_Div]
+	case exponent != math.Trunc(exponent) || math.Abs(exponent) > maxPowerExponent:
+		return opCosts[NodeOp_Power]
+	}
+
+	cost := float64(len(additionChain(int(math.Abs(exponent))))-1) * opCosts[NodeOp_Mul]
+	if exponent < 0 {
+		cost += opCosts[NodeOp_Div]
+	}
+
+	return cost
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+find returns the canonical class of a class.
+*/
+func (eg *EGraph) find(id eClassId) eClassId {
+	for eg.parents[id] != id {
+		eg.parents[id] = eg.parents[eg.parents[id]]
+		id = eg.parents[id]
+	}
+
+	return id
+}
+
+/*
+key returns the hash key of an e-node with canonical children.
+*/
+func (eg *EGraph) key(n *eNode) string {
+	switch {
+	case n.input != nil:
+		return "i:" + n.input.name
+	case n.constant:
+		return "c:" + strconv.FormatFloat(n.value, 'g', -1, 64)
+	}
+
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(n.op)))
+	for _, child := range n.children {
+		b.WriteString(",")
+		b.WriteString(strconv.Itoa(int(eg.find(child))))
+	}
+
+	return b.String()
+}
+
+/*
+add adds an e-node if an equal one doesn't exist yet, and returns its class. An
+operation on constant classes is folded into a constant.
+*/
+func (eg *EGraph) add(n *eNode) eClassId {
+	for i, child := range n.children {
+		n.children[i] = eg.find(child)
+	}
+
+	key := eg.key(n)
+	if id, exist := eg.hashcons[key]; exist {
+		return eg.find(id)
+	}
+
+	id := eClassId(len(eg.parents))
+	eg.parents = append(eg.parents, id)
+	eg.classes[id] = &eClass{nodes: []*eNode{n}, constant: n.constant, value: n.value}
+	eg.hashcons[key] = id
+
+	if value, ok := eg.fold(n); ok {
+		eg.union(id, eg.addConstant(value))
+	}
+
+	return eg.find(id)
+}
+
+/*
+addConstant adds a constant leaf and returns its class.
+*/
+func (eg *EGraph) addConstant(value float64) eClassId {
+	return eg.add(&eNode{constant: true, value: value})
+}
+
+/*
+addOperation adds an operation e-node and returns its class.
+*/
+func (eg *EGraph) addOperation(op NodeOp, children ...eClassId) eClassId {
+	return eg.add(&eNode{op: op, children: children})
+}
+
+/*
+signed returns the class, or the class of its negation if negate is true.
+*/
+func (eg *EGraph) signed(id eClassId, negate bool) eClassId {
+	if negate {
+		return eg.addOperation(NodeOp_Sub, id)
+	}
+
+	return id
+}
+
+/*
+fold evaluates an operation whose operands are all constant classes.
+*/
+func (eg *EGraph) fold(n *eNode) (float64, bool) {
+	if n.input != nil || n.constant || len(n.children) == 0 {
+		return 0, false
+	}
+
+	values := make([]float64, len(n.children))
+	for i, child := range n.children {
+		value, ok := eg.constantOf(child)
+		if !ok {
+			return 0, false
+		}
+		values[i] = value
+	}
+
+	var value float64
+	switch {
+	case n.op == NodeOp_Sub && len(values) == 1:
+		value = -values[0]
+	case n.op == NodeOp_Add:
+		value = values[0] + values[1]
+	case n.op == NodeOp_Mul:
+		value = values[0] * values[1]
+	case n.op == NodeOp_Div:
+		value = values[0] / values[1]
+	case n.op == NodeOp_Power && values[1] == math.Trunc(values[1]):
+		value = math.Pow(values[0], values[1])
+	default:
+		return 0, false
+	}
+
+	// Leave non-finite results to be computed by the hardware
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+
+	return value, true
+}
+
+/*
+constantOf returns the value of a class if it's a constant.
+*/
+func (eg *EGraph) constantOf(id eClassId) (float64, bool) {
+	class := eg.classes[eg.find(id)]
+	return class.value, class.constant
+}
+
+/*
+union merges two classes, the one with the smaller id stays canonical.
+*/
+func (eg *EGraph) union(a, b eClassId) {
+	a, b = eg.find(a), eg.find(b)
+	if a == b {
+		return
+	}
+	if b < a {
+		a, b = b, a
+	}
+
+	eg.parents[b] = a
+
+	classA, classB := eg.classes[a], eg.classes[b]
+	classA.nodes = append(classA.nodes, classB.nodes...)
+	if classB.constant && !classA.constant {
+		classA.constant, classA.value = true, classB.value
+	}
+
+	delete(eg.classes, b)
+}
+
+/*
+rebuild restores the invariants after unions. Classes containing equal e-nodes
+are merged, which may make more e-nodes equal, until nothing changes, and then
+duplicated e-nodes in each class are removed.
+*/
+func (eg *EGraph) rebuild() {
+	type pair struct{ a, b eClassId }
+
+	for {
+		unions := []pair{}
+		hashcons := make(map[string]eClassId)
+
+		for _, id := range eg.sortedClassIds() {
+			for _, n := range eg.classes[id].nodes {
+				for i, child := range n.children {
+					n.children[i] = eg.find(child)
+				}
+
+				key := eg.key(n)
+				if other, exist := hashcons[key]; !exist {
+					hashcons[key] = id
+				} else if other != id {
+					unions = append(unions, pair{other, id})
+				}
+			}
+		}
+
+		if len(unions) == 0 {
+			eg.hashcons = hashcons
+			break
+		}
+
+		for _, u := range unions {
+			eg.union(u.a, u.b)
+		}
+	}
+
+	for _, class := range eg.classes {
+		kept := make(map[string]*eNode)
+		nodes := []*eNode{}
+
+		for _, n := range class.nodes {
+			key := eg.key(n)
+			if k, exist := kept[key]; exist {
+				// Keep the origin of a duplicated e-node
+				if k.origin == nil {
+					k.origin = n.origin
+				}
+				continue
+			}
+
+			kept[key] = n
+			nodes = append(nodes, n)
+		}
+
+		class.nodes = nodes
+	}
+}
+
+/*
+sortedClassIds returns the canonical class ids in increasing order, so that
+rules are applied deterministically.
+*/
+func (eg *EGraph) sortedClassIds() []eClassId {
+	ids := make([]eClassId, 0, len(eg.classes))
+	for id := range eg.classes {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+/*
+nodesOf returns the e-nodes of a class with the given operation. A constant class
+only matches as a constant, since every expression folding to the constant, such
+as x*0 for any x, ends up in its class.
+*/
+func (eg *EGraph) nodesOf(id eClassId, op NodeOp) []*eNode {
+	nodes := []*eNode{}
+
+	class := eg.classes[eg.find(id)]
+	if class.constant {
+		return nodes
+	}
+
+	for _, n := range class.nodes {
+		if n.input == nil && !n.constant && n.op == op {
+			nodes = append(nodes, n)
+		}
+	}
+
+	return nodes
+}
+
+/*
+isConstant checks if a class is a constant of the given value.
+*/
+func (eg *EGraph) isConstant(id eClassId, value float64) bool {
+	v, ok := eg.constantOf(id)
+	return ok && v == value
+}
@@ -0,0 +1,249 @@
+package forge
+
+import "math"
+
+/*
+eRules are the rewrite rules applied by EGraph.Saturate(). Rules only match the
+operands of an e-node one level deep, deeper patterns are matched because every
+class holds all the equivalent forms found so far. Negations are unary
+subtractions, see eNode.
+*/
+var eRules = []eRule{
+	// Constant folding of operations whose operands became constant by union
+	{"fold", func(eg *EGraph, n *eNode) []eClassId {
+		if value, ok := eg.fold(n); ok {
+			return []eClassId{eg.addConstant(value)}
+		}
+		return nil
+	}},
+
+	// a+b = b+a, a*b = b*a
+	{"commute", func(eg *EGraph, n *eNode) []eClassId {
+		if n.op == NodeOp_Add || n.op == NodeOp_Mul {
+			return []eClassId{eg.addOperation(n.op, n.children[1], n.children[0])}
+		}
+		return nil
+	}},
+
+	// (a+b)+c = a+(b+c), (a*b)*c = a*(b*c)
+	{"associate", func(eg *EGraph, n *eNode) []eClassId {
+		if n.op != NodeOp_Add && n.op != NodeOp_Mul {
+			return nil
+		}
+
+		equivalents := []eClassId{}
+		for _, m := range eg.nodesOf(n.children[0], n.op) {
+			bc := eg.addOperation(n.op, m.children[1], n.children[1])
+			equivalents = append(equivalents, eg.addOperation(n.op, m.children[0], bc))
+		}
+		return equivalents
+	}},
+
+	// a*(b+c) = a*b+a*c
+	{"distribute", func(eg *EGraph, n *eNode) []eClassId {
+		if n.op != NodeOp_Mul {
+			return nil
+		}
+
+		a := n.children[0]
+		equivalents := []eClassId{}
+		for _, m := range eg.nodesOf(n.children[1], NodeOp_Add) {
+			ab := eg.addOperation(NodeOp_Mul, a, m.children[0])
+			ac := eg.addOperation(NodeOp_Mul, a, m.children[1])
+			equivalents = append(equivalents, eg.addOperation(NodeOp_Add, ab, ac))
+		}
+		return equivalents
+	}},
+
+	// a*b+a*c = a*(b+c)
+	{"factor", func(eg *EGraph, n *eNode) []eClassId {
+		if n.op != NodeOp_Add {
+			return nil
+		}
+
+		// Index the products of one operand by their first factor, commutativity
+		// makes classes contain many products so comparing all pairs is too slow
+		products := make(map[eClassId][]*eNode)
+		for _, m1 := range eg.nodesOf(n.children[1], NodeOp_Mul) {
+			a := eg.find(m1.children[0])
+			products[a] = append(products[a], m1)
+		}
+
+		equivalents := []eClassId{}
+		for _, m0 := range eg.nodesOf(n.children[0], NodeOp_Mul) {
+			for _, m1 := range products[eg.find(m0.children[0])] {
+				bc := eg.addOperation(NodeOp_Add, m0.children[1], m1.children[1])
+				equivalents = append(equivalents, eg.addOperation(NodeOp_Mul, m0.children[0], bc))
+			}
+		}
+		return equivalents
+	}},
+
+	// x+0 = x, x*1 = x, x*0 = 0, x*(-1) = -x, x/1 = x
+	{"identity", func(eg *EGraph, n *eNode) []eClassId {
+		switch {
+		case n.op == NodeOp_Add && eg.isConstant(n.children[1], 0):
+			return []eClassId{n.children[0]}
+		case n.op == NodeOp_Mul && eg.isConstant(n.children[1], 1):
+			return []eClassId{n.children[0]}
+		case n.op == NodeOp_Mul && eg.isConstant(n.children[1], 0):
+			return []eClassId{eg.addConstant(0)}
+		case n.op == NodeOp_Mul && eg.isConstant(n.children[1], -1):
+			return []eClassId{eg.signed(n.children[0], true)}
+		case n.op == NodeOp_Div && eg.isConstant(n.children[1], 1):
+			return []eClassId{n.children[0]}
+		}
+		return nil
+	}},
+
+	// -(-x) = x, x+(-x) = 0
+	{"negate", func(eg *EGraph, n *eNode) []eClassId {
+		equivalents := []eClassId{}
+
+		switch n.op {
+		case NodeOp_Sub:
+			for _, m := range eg.nodesOf(n.children[0], NodeOp_Sub) {
+				equivalents = append(equivalents, m.children[0])
+			}
+		case NodeOp_Add:
+			for _, m := range eg.nodesOf(n.children[1], NodeOp_Sub) {
+				if eg.find(m.children[0]) == eg.find(n.children[0]) {
+					equivalents = append(equivalents, eg.addConstant(0))
+				}
+			}
+		}
+		return equivalents
+	}},
+
+	// -(a+b) = (-a)+(-b), and the other way around
+	{"negate-sum", func(eg *EGraph, n *eNode) []eClassId {
+		equivalents := []eClassId{}
+
+		switch n.op {
+		case NodeOp_Sub:
+			for _, m := range eg.nodesOf(n.children[0], NodeOp_Add) {
+				equivalents = append(equivalents, eg.addOperation(NodeOp_Add,
+					eg.signed(m.children[0], true), eg.signed(m.children[1], true)))
+			}
+		case NodeOp_Add:
+			for _, m0 := range eg.nodesOf(n.children[0], NodeOp_Sub) {
+				for _, m1 := range eg.nodesOf(n.children[1], NodeOp_Sub) {
+					sum := eg.addOperation(NodeOp_Add, m0.children[0], m1.children[0])
+					equivalents = append(equivalents, eg.signed(sum, true))
+				}
+			}
+		}
+		return equivalents
+	}},
+
+	// (-a)*b = -(a*b), a*(-b) = -(a*b), and the same for division
+	{"negate-product", func(eg *EGraph, n *eNode) []eClassId {
+		equivalents := []eClassId{}
+
+		switch n.op {
+		case NodeOp_Mul, NodeOp_Div:
+			for _, m := range eg.nodesOf(n.children[0], NodeOp_Sub) {
+				product := eg.addOperation(n.op, m.children[0], n.children[1])
+				equivalents = append(equivalents, eg.signed(product, true))
+			}
+			for _, m := range eg.nodesOf(n.children[1], NodeOp_Sub) {
+				product := eg.addOperation(n.op, n.children[0], m.children[0])
+				equivalents = append(equivalents, eg.signed(product, true))
+			}
+		case NodeOp_Sub:
+			for _, m := range eg.nodesOf(n.children[0], NodeOp_Mul) {
+				equivalents = append(equivalents,
+					eg.addOperation(NodeOp_Mul, eg.signed(m.children[0], true), m.children[1]))
+			}
+		}
+		return equivalents
+	}},
+
+	// Power(x,0) = 1, Power(x,1) = x, Power(x,k) = x*Power(x,k-1),
+	// Power(-x,k) = Power(x,k) for an even k and -Power(x,k) for an odd k
+	{"power", func(eg *EGraph, n *eNode) []eClassId {
+		if n.op != NodeOp_Power {
+			return nil
+		}
+
+		x := n.children[0]
+		exponent, ok := eg.constantOf(n.children[1])
+		if !ok || exponent != math.Trunc(exponent) || math.Abs(exponent) > maxPowerExponent {
+			return nil
+		}
+
+		equivalents := []eClassId{}
+		switch {
+		case exponent == 0:
+			equivalents = append(equivalents, eg.addConstant(1))
+		case exponent == 1:
+			equivalents = append(equivalents, x)
+		case exponent >= 2:
+			lower := eg.addOperation(NodeOp_Power, x, eg.addConstant(exponent-1))
+			equivalents = append(equivalents, eg.addOperation(NodeOp_Mul, x, lower))
+		}
+
+		for _, m := range eg.nodesOf(x, NodeOp_Sub) {
+			power := eg.addOperation(NodeOp_Power, m.children[0], n.children[1])
+			equivalents = append(equivalents, eg.signed(power, math.Mod(exponent, 2) != 0))
+		}
+		return equivalents
+	}},
+
+	// sin(-x) = -sin(x), cos(-x) = cos(x), and the outputs of sincos(x) are
+	// sin(x) and cos(x)
+	{"trig", func(eg *EGraph, n *eNode) []eClassId {
+		equivalents := []eClassId{}
+
+		switch n.op {
+		case NodeOp_Sin:
+			for _, m := range eg.nodesOf(n.children[0], NodeOp_Sub) {
+				equivalents = append(equivalents, eg.signed(eg.addOperation(NodeOp_Sin, m.children[0]), true))
+			}
+		case NodeOp_Cos:
+			for _, m := range eg.nodesOf(n.children[0], NodeOp_Sub) {
+				equivalents = append(equivalents, eg.addOperation(NodeOp_Cos, m.children[0]))
+			}
+		case NodeOp_SinCosSin:
+			for _, m := range eg.nodesOf(n.children[0], NodeOp_SinCos) {
+				equivalents = append(equivalents, eg.addOperation(NodeOp_Sin, m.children[0]))
+			}
+		case NodeOp_SinCosCos:
+			for _, m := range eg.nodesOf(n.children[0], NodeOp_SinCos) {
+				equivalents = append(equivalents, eg.addOperation(NodeOp_Cos, m.children[0]))
+			}
+		}
+		return equivalents
+	}},
+
+	// sin(x)*sin(x) + cos(x)*cos(x) = 1
+	{"pythagoras", func(eg *EGraph, n *eNode) []eClassId {
+		if n.op != NodeOp_Add {
+			return nil
+		}
+
+		// squareOf returns the classes whose square is in a class
+		squareOf := func(id eClassId) []eClassId {
+			bases := []eClassId{}
+			for _, m := range eg.nodesOf(id, NodeOp_Mul) {
+				if eg.find(m.children[0]) == eg.find(m.children[1]) {
+					bases = append(bases, m.children[0])
+				}
+			}
+			return bases
+		}
+
+		for _, s := range squareOf(n.children[0]) {
+			for _, c := range squareOf(n.children[1]) {
+				for _, sin := range eg.nodesOf(s, NodeOp_Sin) {
+					for _, cos := range eg.nodesOf(c, NodeOp_Cos) {
+						if eg.find(sin.children[0]) == eg.find(cos.children[0]) {
+							return []eClassId{eg.addConstant(1)}
+						}
+					}
+				}
+			}
+		}
+		return nil
+	}},
+}
@@ -0,0 +1,125 @@
+package forge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOptimizeByEGraph(t *testing.T) {
+	tests := []struct {
+		assignment string
+		ops        map[NodeOp]int
+	}{
+		{"y[0] = x[0]*x[1] + x[0]*x[2]", map[NodeOp]int{NodeOp_Mul: 1, NodeOp_Add: 1}},
+		{"y[0] = (x[0] + 0)*1 + x[1]*0", map[NodeOp]int{}},
+		{"y[0] = power(sin(x[0]), 2) + power(cos(x[0]), 2)", map[NodeOp]int{}},
+		// -(a*b) + a*b is 0 once signs are e-nodes
+		{"y[0] = x[2] + x[0]*x[1] - x[1]*x[0]", map[NodeOp]int{}},
+		// Multiplication chains aren't folded into powers, which cost the
+		// multiplications of their addition chains
+		{"y[0] = x[0]*x[0]*x[0]*x[0]", map[NodeOp]int{NodeOp_Mul: 3}},
+		{"y[0] = power(x[0], 4)", map[NodeOp]int{NodeOp_Power: 1}},
+		{"y[0] = x[0]*power(x[0], 4)", map[NodeOp]int{NodeOp_Mul: 1, NodeOp_Power: 1}},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignment)
+		numOps := g.NumOperationNodes()
+
+		numSaved := 0
+		checkEquivalence(t, g, func(g *Graph) {
+			numSaved = g.OptimizeByEGraph(CreateProcessor(), DefaultEGraphNodeBudget)
+		})
+
+		if ops := countOps(g); !reflect.DeepEqual(ops, test.ops) {
+			t.Errorf("%s: got operations %v, want %v", test.assignment, ops, test.ops)
+		}
+		if n := g.NumOperationNodes(); numSaved != numOps-n {
+			t.Errorf("%s: got %d saved, but %d operations became %d", test.assignment, numSaved, numOps, n)
+		}
+	}
+}
+
+func TestOptimizeByEGraphKeepsCheapestGraph(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0]*x[1] + x[2]")
+	add := getNode(t, g, "ARRy[0]").Fanin(0)
+
+	if n := g.OptimizeByEGraph(CreateProcessor(), DefaultEGraphNodeBudget); n != 0 {
+		t.Errorf("got %d saved, want 0", n)
+	}
+	if getNode(t, g, "ARRy[0]").Fanin(0) != add || g.NumOperationNodes() != 2 {
+		t.Errorf("the graph is rebuilt without getting cheaper")
+	}
+}
+
+func TestEGraphSaturate(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0] + x[1]")
+
+	// Commutativity adds x[1]+x[0] once and then nothing new
+	eg := CreateEGraph()
+	eg.Import(g)
+	if n := eg.Saturate(DefaultEGraphNodeBudget, maxEGraphIterations); n >= maxEGraphIterations {
+		t.Errorf("got %d iterations, want saturation before %d", n, maxEGraphIterations)
+	}
+	if eg.NumClasses() != 3 || eg.NumNodes() != 4 {
+		t.Errorf("got %d classes and %d e-nodes, want 3 and 4", eg.NumClasses(), eg.NumNodes())
+	}
+
+	// Saturation stops once the budget is reached
+	g = buildTestGraph(t, "y[0] = x[0]*x[1]*x[2]*x[3]*x[4]*x[5]*x[6]*x[7]")
+	eg = CreateEGraph()
+	eg.Import(g)
+	numNodes := eg.NumNodes()
+
+	if n := eg.Saturate(numNodes, maxEGraphIterations); n != 0 || eg.NumNodes() != numNodes {
+		t.Errorf("got %d iterations and %d e-nodes with a budget of %d", n, eg.NumNodes(), numNodes)
+	}
+	eg.Saturate(2*numNodes, maxEGraphIterations)
+	if eg.NumNodes() > 2*numNodes+len(eRules) {
+		t.Errorf("got %d e-nodes with a budget of %d", eg.NumNodes(), 2*numNodes)
+	}
+}
+
+func TestEGraphIgnoresDeadOperations(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0]*x[1] + x[2]")
+
+	// Dead operations don't make the extracted graph look cheaper
+	for i := 0; i < 4; i++ {
+		addOperation(t, g, "/", getNode(t, g, "ARRx[0]"), getNode(t, g, "ARRx[1]"))
+	}
+
+	eg := CreateEGraph()
+	eg.Import(g)
+	eg.Saturate(DefaultEGraphNodeBudget, maxEGraphIterations)
+
+	if eg.Extract(g, CreateProcessor()) {
+		t.Errorf("the graph is rebuilt without getting cheaper")
+	}
+}
+
+func TestEPowerCost(t *testing.T) {
+	opCosts := eOpCosts(CreateProcessor())
+	mul, div, sqrt := opCosts[NodeOp_Mul], opCosts[NodeOp_Div], opCosts[NodeOp_Sqrt]
+
+	tests := []struct {
+		exponent float64
+		cost     float64
+	}{
+		{0, 0},
+		{1, 0},
+		{2, mul},
+		{4, 2 * mul},
+		{15, 5 * mul},
+		{-3, 2*mul + div},
+		{0.5, sqrt},
+		{-0.5, sqrt + div},
+		{1.5, opCosts[NodeOp_Power]},
+		{maxPowerExponent + 1, opCosts[NodeOp_Power]},
+	}
+
+	for _, test := range tests {
+		if cost := ePowerCost(test.exponent, opCosts); cost != test.cost {
+			t.Errorf("power %v: got cost %v, want %v", test.exponent, cost, test.cost)
+		}
+	}
+}
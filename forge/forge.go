@@ -1,6 +1,6 @@
 package forge
 
-//import "fmt"
+import "fmt"
 
 /*
 Forge is the main compiler instance.
@@ -8,29 +8,291 @@ Forge is the main compiler instance.
 type Forge struct {
 	parser    Parser
 	scheduler Scheduler
+
+	// Variables whose input nodes are shared when multiple graphs are merged
+	sharedInputs map[string]bool
+	// Array indices of output nodes to keep, all outputs are kept if empty
+	selectedOutputs map[int]bool
+	// Allow transformations that change floating point results slightly
+	fastMath bool
+
+	// Optimization pipeline, the one of the default optimization level is used
+	// if not set
+	pipeline    string
+	hasPipeline bool
+	// Unify inputs by name across graphs and eliminate common subexpressions in
+	// the merged graph
+	crossKernelCSE bool
+	// Maximum estimated relative error of reassociating a sum, no limit if 0
+	maxReassociationError float64
+	// Maximum number of e-nodes of the e-graph optimizer, the default if 0
+	eGraphNodeBudget int
+	// User-defined rules applied by the rewrite pass
+	rewriteRules []*RewriteRule
+	// Check that every pass retains the outputs of the parsed graph
+	verify      bool
+	evalOptions EvalOptions
+}
+
+/*
+FastMath allows transformations in graphs built afterward that may change
+floating point results slightly, such as replacing a division by a constant with
+a multiplication by its inexact inverse.
+*/
+func (f *Forge) FastMath(enable bool) {
+	f.fastMath = enable
+}
+
+/*
+HashConsing makes the parser build repeated operations on the same operands only
+once in graphs built afterward, instead of leaving them to common subexpression
+elimination, which reduces memory and parse time of large files.
+*/
+func (f *Forge) HashConsing(enable bool) {
+	f.parser.hashConsing = enable
+}
+
+/*
+SetOptLevel sets the optimization pipeline of graphs built afterward to the one
+of an optimization level, see OptLevelPipelines.
+*/
+func (f *Forge) SetOptLevel(level int) error {
+	if level < 0 || level >= len(OptLevelPipelines) {
+		return fmt.Errorf("unsupported optimization level %d", level)
+	}
+
+	f.pipeline = OptLevelPipelines[level]
+	f.hasPipeline = true
+
+	return nil
+}
+
+/*
+SetPipeline sets the optimization pipeline of graphs built afterward, see
+PassManager.SetPipeline() for the format.
+*/
+func (f *Forge) SetPipeline(spec string) error {
+	// Check the pipeline now instead of when a graph is built
+	if err := CreatePassManager(PassOptions{}).SetPipeline(spec); err != nil {
+		return err
+	}
+
+	f.pipeline = spec
+	f.hasPipeline = true
+
+	return nil
+}
+
+/*
+Verify makes graphs built afterward be evaluated with random inputs after parsing
+and checked against the result after every optimization pass. Building a graph
+fails if a pass changes the outputs beyond the tolerances.
+*/
+func (f *Forge) Verify(enable bool, options EvalOptions) {
+	f.verify = enable
+	f.evalOptions = options
+}
+
+/*
+LimitReassociationError makes graphs built afterward keep sums unbalanced if the
+estimated relative error of reassociating them is above maxRelError, see
+Graph.MaximizeParallelismWithinError(). The worst relative error of each output
+against the unoptimized graph is returned in the BuildReport. A limit of 0
+removes the limit.
+*/
+func (f *Forge) LimitReassociationError(maxRelError float64) {
+	f.maxReassociationError = maxRelError
+}
+
+/*
+EGraphNodeBudget sets the maximum number of e-nodes of the e-graph optimizer in
+graphs built afterward, see Graph.OptimizeByEGraph(). The pass runs at -O3 or if
+it's in the pipeline, a budget of 0 uses DefaultEGraphNodeBudget.
+*/
+func (f *Forge) EGraphNodeBudget(budget int) {
+	f.eGraphNodeBudget = budget
+}
+
+/*
+LoadRewriteRules loads user-defined rewrite rules from a rule file, and applies
+them to graphs built afterward in the rewrite pass, see RewriteRule for the
+format. The number of times each rule fires is in the report of the pass.
+*/
+func (f *Forge) LoadRewriteRules(filename string) error {
+	rules, err := LoadRewriteRules(filename)
+	if err != nil {
+		return err
+	}
+
+	f.rewriteRules = append(f.rewriteRules, rules...)
+
+	return nil
+}
+
+/*
+CrossKernelCSE makes graphs built afterward share all their input nodes by the
+original variable name, as if every variable is given to ShareInputs(), so that
+EliminateCrossKernelRedundancy() can find subexpressions computed by multiple
+graphs.
+*/
+func (f *Forge) CrossKernelCSE(enable bool) {
+	f.crossKernelCSE = enable
+}
+
+/*
+SelectOutputs keeps only output nodes with the given array indices, and their
+transitive fanin cones, in graphs built afterward.
+*/
+func (f *Forge) SelectOutputs(indices []int) {
+	if f.selectedOutputs == nil {
+		f.selectedOutputs = make(map[int]bool)
+	}
+
+	for _, index := range indices {
+		f.selectedOutputs[index] = true
+	}
+}
+
+/*
+ShareInputs declares input variables that are shared by all graphs, for example
+"var1" for the input nodes var1[0], var1[1], and so on.
+
+When multiple graphs are built, shared input nodes and constant nodes with the
+same value are unified in the merged graph instead of being duplicated, so they
+are loaded only once.
+*/
+func (f *Forge) ShareInputs(names []string) {
+	if f.sharedInputs == nil {
+		f.sharedInputs = make(map[string]bool)
+	}
+
+	for _, name := range names {
+		f.sharedInputs[name] = true
+	}
+}
+
+/*
+isShared checks if a node is shared by all graphs.
+*/
+func (f *Forge) isShared(n *Node) bool {
+	if len(f.sharedInputs) == 0 && !f.crossKernelCSE {
+		return false
+	}
+
+	switch n.kind {
+	case NodeKind_Input:
+		return f.crossKernelCSE || f.sharedInputs[n.VariableName()]
+	case NodeKind_Constant:
+		return true
+	}
+
+	return false
+}
+
+/*
+BuildReport records the results of building a graph for a source file.
+*/
+type BuildReport struct {
+	Filename string
+
+	// Repeated operations built only once by hash consing while parsing, see
+	// HashConsing()
+	NumSharedOperations int
+	// Reports of the optimization passes in the order they ran
+	Passes []PassReport
+	// Warnings of the optimization pipeline, see PassManager.Warnings()
+	Warnings []string
+	// Worst relative error of each output against the unoptimized graph by the
+	// output name, only if the reassociation error is limited
+	OutputErrors map[string]float64
 }
 
 /*
 BuildGraph invokes the parser to parse the C++ source file and build a graph for it.
+
+The returned report is nil if the source file can't be parsed, otherwise it
+holds what is known so far even if an error is returned.
 */
-func (f *Forge) BuildGraph(filename, postfix string) {
-	g, _ := f.parser.Parse(filename)
+func (f *Forge) BuildGraph(filename, postfix string) (*BuildReport, error) {
+	g, err := f.parser.Parse(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &BuildReport{Filename: filename, NumSharedOperations: g.NumSharedOperations()}
+
+	if len(f.selectedOutputs) > 0 {
+		names := []string{}
+		for _, node := range g.sortedOutputNodes() {
+			if f.selectedOutputs[node.ArrayIndex()] {
+				names = append(names, node.name)
+			}
+		}
+
+		if len(names) == 0 {
+			return report, fmt.Errorf("no selected output in %s", filename)
+		}
+
+		if g, err = g.ExtractOutputs(names); err != nil {
+			return report, err
+		}
+	}
+
+	if f.scheduler.processor == nil {
+		f.scheduler.processor = CreateProcessor()
+	}
+	processor := f.scheduler.processor
+
+	// Random inputs for estimating errors are the verification inputs if given
+	samples := DefaultEvalOptions()
+	if f.verify {
+		samples = f.evalOptions
+	}
 
-	// Evaluate the graph with random inputs and set the outputs as golden
-	//g.EvaluateGolden(1)
+	pm := CreatePassManager(PassOptions{
+		FastMath: f.fastMath,
+		// Lower non-integer powers to exp and log only if the processor supports them
+		LowerExpLog:           processor.Supports(NodeOp_Exp) && processor.Supports(NodeOp_Log),
+		MaxReassociationError: f.maxReassociationError,
+		Samples:               samples,
+		Processor:             processor,
+		EGraphNodeBudget:      f.eGraphNodeBudget,
+		RewriteRules:          f.rewriteRules,
+	})
+	if f.hasPipeline {
+		if err := pm.SetPipeline(f.pipeline); err != nil {
+			return report, err
+		}
+	}
 
-	g.SimplifyArithmetic()
-	g.EliminateDuplicatedOperation()
-	g.MaximizeParallelism()
-	g.DeleteUnusedNodes()
+	pm.Verify(f.verify, f.evalOptions)
 
-	// Evaluate the graph again using the same inputs and compare with the golden outputs
-	//g.EvaluateCompare()
+	// The pass manager evaluates the golden result itself when verifying
+	if f.maxReassociationError > 0 && !f.verify {
+		if err := g.EvaluateGolden(samples); err != nil {
+			return report, fmt.Errorf("problem evaluating %s: %v", filename, err)
+		}
+	}
+
+	err = pm.Run(g)
+
+	report.Passes = pm.Reports()
+	report.Warnings = pm.Warnings()
+
+	if err != nil {
+		return report, fmt.Errorf("problem optimizing graph for %s: %v", filename, err)
+	}
+
+	if f.maxReassociationError > 0 {
+		if report.OutputErrors, err = g.OutputErrors(); err != nil {
+			return report, fmt.Errorf("problem evaluating %s: %v", filename, err)
+		}
+	}
 
 	//g.Analyze()
 
 	if postfix != "" {
-		g.AddPostfix(postfix)
+		g.AddPostfixExcept(postfix, f.isShared)
 	}
 
 	// Pass the graph to the scheduler
@@ -39,13 +301,45 @@ func (f *Forge) BuildGraph(filename, postfix string) {
 	} else {
 		if f.scheduler.mergedGraph == nil {
 			f.scheduler.mergedGraph = f.scheduler.graph
-			f.scheduler.mergedGraph.Merge(g)
+		}
+
+		if len(f.sharedInputs) == 0 && !f.crossKernelCSE {
+			err = f.scheduler.mergedGraph.Merge(g)
 		} else {
-			f.scheduler.mergedGraph.Merge(g)
+			err = f.scheduler.mergedGraph.MergeShared(g)
+		}
+		if err != nil {
+			return report, fmt.Errorf("problem merging graph for %s: %v", filename, err)
 		}
 
 		f.scheduler.graph = g
 	}
+
+	return report, nil
+}
+
+/*
+EliminateCrossKernelRedundancy eliminates common subexpressions across all graphs
+built so far by value numbering their merged graph, for example sin(q[3]) that is
+computed by every kernel, then deletes nodes that are no longer used. The number
+of eliminated operations is returned.
+
+Graphs should be built with CrossKernelCSE() enabled so that their inputs are
+unified. The merged graph becomes the graph scheduled by ScheduleGraph(), so
+graphs shouldn't be scheduled individually.
+*/
+func (f *Forge) EliminateCrossKernelRedundancy() int {
+	g := f.scheduler.mergedGraph
+	if g == nil {
+		return 0
+	}
+
+	numEliminated := g.EliminateDuplicatedOperation()
+	g.EliminateDeadCode()
+
+	f.scheduler.graph = g
+
+	return numEliminated
 }
 
 /*
@@ -56,13 +350,31 @@ func (f *Forge) ScheduleGraph() {
 		f.scheduler.processor = CreateProcessor()
 	}
 
+	f.scheduler.shareInputs = len(f.sharedInputs) > 0 || f.crossKernelCSE
+
 	f.scheduler.ScheduleHeuristic()
 }
 
 func (f *Forge) Output() {
+	f.outputGraph().OutputDotFile()
+}
+
+/*
+Stats returns the statistics of the graph, or the merged graph if multiple
+graphs are built.
+*/
+func (f *Forge) Stats() GraphStats {
+	return f.outputGraph().Stats()
+}
+
+/*
+outputGraph returns the merged graph if multiple graphs are built, otherwise the
+only graph.
+*/
+func (f *Forge) outputGraph() *Graph {
 	if f.scheduler.mergedGraph == nil {
-		f.scheduler.graph.OutputDotFile()
-	} else {
-		f.scheduler.mergedGraph.OutputDotFile()
+		return f.scheduler.graph
 	}
+
+	return f.scheduler.mergedGraph
 }
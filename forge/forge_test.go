@@ -0,0 +1,47 @@
+package forge
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestEliminateCrossKernelRedundancy(t *testing.T) {
+	f := Forge{}
+	f.CrossKernelCSE(true)
+
+	// Both kernels compute sin(x[0])*x[1], the second one negated
+	kernels := []*Graph{
+		buildTestGraph(t, "y[0] = sin(x[0])*x[1] + x[2]"),
+		buildTestGraph(t, "y[0] = x[2] - x[1]*sin(x[0])", "y[1] = cos(x[0])"),
+	}
+
+	// Merge the kernels like BuildGraph() does
+	for i, g := range kernels {
+		g.AddPostfixExcept("_"+strconv.Itoa(i+1), f.isShared)
+	}
+	merged := kernels[0]
+	if err := merged.MergeShared(kernels[1]); err != nil {
+		t.Fatal(err)
+	}
+	f.scheduler.graph = kernels[1]
+	f.scheduler.mergedGraph = merged
+
+	checkEquivalence(t, merged, func(g *Graph) {
+		// The sine and the product are computed once
+		if n := f.EliminateCrossKernelRedundancy(); n != 2 {
+			t.Errorf("got %d eliminated, want 2", n)
+		}
+	})
+
+	want := map[NodeOp]int{NodeOp_Sin: 1, NodeOp_Mul: 1, NodeOp_Add: 2, NodeOp_Cos: 1}
+	if ops := countOps(merged); !reflect.DeepEqual(ops, want) {
+		t.Errorf("got operations %v, want %v", ops, want)
+	}
+	if n := merged.NumOutputNodes(); n != 3 {
+		t.Errorf("got %d outputs, want 3", n)
+	}
+	if f.scheduler.graph != merged {
+		t.Errorf("the merged graph is not scheduled")
+	}
+}
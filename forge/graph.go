@@ -2,7 +2,9 @@ package forge
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 /*
@@ -15,11 +17,23 @@ type Graph struct {
 	operationNodes map[string]*Node
 	constantNodes  map[string]*Node
 
+	// Identification number of the next operation node, operation nodes are
+	// named by this number so it never decreases even if nodes are deleted
+	nextOperationId int
+
+	// Operation nodes by their operation and operands while the graph is built,
+	// nil if hash consing is disabled, see GetOperationNode()
+	operationKeys       map[string]*Node
+	numSharedOperations int
+
+	evalOptions  EvalOptions
 	inputValues  []map[string]float64
 	outputValues []map[string]float64
 
 	isLevelized bool // clear this flag whenever the graph structure is modified
 	maxLevel    int
+	topoOrder   []*Node
+	cycleNode   *Node // a node on a combinational cycle found by Levelize()
 }
 
 // -----------------------------------------------------------------------------
@@ -42,9 +56,14 @@ func CreateGraph() *Graph {
 /*
 Legalize fills in some missing information after the graph is built.
 
-This function should be invoked after the graph is built.
+This function should be invoked after the graph is built. It returns an error if
+the graph contains a cycle, for example a variable assigned from itself.
 */
-func (g *Graph) Legalize() {
+func (g *Graph) Legalize() error {
+	// Operations are changed from here on, so they can't be looked up by their
+	// operands anymore
+	g.operationKeys = nil
+
 	// Determine node kind for undetermined nodes and delete internal nodes
 	for name, node := range g.allNodes {
 		if node.kind == NodeKind_Undetermined {
@@ -72,16 +91,26 @@ func (g *Graph) Legalize() {
 		}
 	}
 
+	// Set the value for constant nodes, sign propagation below depends on
+	// constant exponents
+	for _, n := range g.constantNodes {
+		value, err := strconv.ParseFloat(n.name[3:], 64)
+		if err != nil {
+			return fmt.Errorf("invalid constant %s: %v", n.name, err)
+		}
+		n.value = value
+	}
+
 	// Do some simple operation transformation here
 	g.Levelize()
-
-	pq := CreateNodePQ()
-	for _, node := range g.operationNodes {
-		pq.Push(NodePQEntry{node, node.level})
+	if g.cycleNode != nil {
+		return fmt.Errorf("graph contains a cycle through node %s", g.cycleNode.name)
 	}
 
-	for pq.Len() > 0 {
-		node := pq.Pop()
+	for _, node := range g.TopologicalOrder() {
+		if node.kind != NodeKind_Operation {
+			continue
+		}
 
 		switch node.op {
 		case NodeOp_Sub:
@@ -93,8 +122,8 @@ func (g *Graph) Legalize() {
 
 				for _, fo := range node.fanouts {
 					fi.AddFanout(fo)
-					fo.ReplaceFanin(node, fi)
-					fo.NegateFaninByNode(fi)
+					index := fo.ReplaceFanin(node, fi)
+					fo.NegateFaninByIndex(index)
 				}
 
 				g.DeleteNodeByName(node.name)
@@ -108,12 +137,9 @@ func (g *Graph) Legalize() {
 		node.PropagateSign()
 	}
 
-	// Set the value for constant nodes
-	for _, n := range g.constantNodes {
-		n.value, _ = strconv.ParseFloat(n.name[3:], 64)
-	}
-
 	g.isLevelized = false
+
+	return nil
 }
 
 // -----------------------------------------------------------------------------
@@ -131,15 +157,83 @@ AddOperationNode adds an operation node to the graph.
 
 Other kinds of nodes should be created by GetNodeByName().
 */
-func (g *Graph) AddOperationNode(opString string) *Node {
-	name := "OPR" + strconv.Itoa(len(g.operationNodes))
-
+func (g *Graph) AddOperationNode(opString string) (*Node, error) {
 	if _, exist := NodeOpLUT[opString]; !exist {
-		fmt.Println("graph error - unsupported operation", opString)
-		return nil
+		return nil, fmt.Errorf("unsupported operation %q", opString)
+	}
+
+	return g.addOperationNode(NodeOpLUT[opString]), nil
+}
+
+/*
+EnableHashConsing makes GetOperationNode() return the existing node for an
+operation with the same operands, so that repeated subexpressions are built only
+once. It must be enabled before the graph is built, and it ends when the graph
+is legalized.
+*/
+func (g *Graph) EnableHashConsing() {
+	if g.operationKeys == nil {
+		g.operationKeys = make(map[string]*Node)
+	}
+}
+
+/*
+GetOperationNode adds an operation node receiving the operands, like
+AddOperationNode() followed by Receive() of each operand. If hash consing is
+enabled and an operation node with the same operation and operands in the same
+order already exists, that node is returned instead.
+*/
+func (g *Graph) GetOperationNode(opString string, operands ...*Node) (*Node, error) {
+	op, exist := NodeOpLUT[opString]
+	if !exist {
+		return nil, fmt.Errorf("unsupported operation %q", opString)
 	}
 
-	newNode := CreateNode(name, NodeKind_Operation, NodeOpLUT[opString])
+	var key string
+	if g.operationKeys != nil {
+		// Operands are not negated while the graph is built, so the key doesn't
+		// include signs
+		b := strings.Builder{}
+		b.WriteString(opString)
+		for _, operand := range operands {
+			b.WriteString(",")
+			b.WriteString(operand.name)
+		}
+		key = b.String()
+
+		if node, exist := g.operationKeys[key]; exist {
+			g.numSharedOperations++
+			return node, nil
+		}
+	}
+
+	node := g.addOperationNode(op)
+	for _, operand := range operands {
+		node.Receive(operand)
+	}
+
+	if g.operationKeys != nil {
+		g.operationKeys[key] = node
+	}
+
+	return node, nil
+}
+
+/*
+NumSharedOperations returns the number of times GetOperationNode() returned an
+existing node because of hash consing.
+*/
+func (g *Graph) NumSharedOperations() int { return g.numSharedOperations }
+
+/*
+addOperationNode adds an operation node to the graph without checking if the
+operation is supported by the parser, it's used by graph transformations.
+*/
+func (g *Graph) addOperationNode(op NodeOp) *Node {
+	name := "OPR" + strconv.Itoa(g.nextOperationId)
+	g.nextOperationId++
+
+	newNode := CreateNode(name, NodeKind_Operation, op)
 
 	g.allNodes[name] = newNode
 	g.operationNodes[name] = newNode
@@ -154,18 +248,20 @@ GetNodeByName get a node by the name, create the node if it doesn't exist.
 
 Operation nodes should be created by AddOperationNode().
 */
-func (g *Graph) GetNodeByName(name string) *Node {
+func (g *Graph) GetNodeByName(name string) (*Node, error) {
 	// Create a new node if a node with the same name does not exist
 	if _, exist := g.allNodes[name]; !exist {
 		var newNode *Node
 
+		if len(name) < 3 {
+			return nil, fmt.Errorf("incorrect node name format %q", name)
+		}
+
 		switch name[0:3] {
 		default:
-			fmt.Println("graph error - incorrect node name format")
-			return nil
+			return nil, fmt.Errorf("incorrect node name format %q", name)
 		case "OPR":
-			fmt.Println("graph error - should not create operation node here")
-			return nil
+			return nil, fmt.Errorf("operation node %s should be created by AddOperationNode()", name)
 		case "CON":
 			newNode = CreateNode(name, NodeKind_Constant, NodeOp_Equal)
 			g.constantNodes[name] = newNode
@@ -180,7 +276,29 @@ func (g *Graph) GetNodeByName(name string) *Node {
 
 	g.isLevelized = false
 
-	return g.allNodes[name]
+	return g.allNodes[name], nil
+}
+
+/*
+GetConstantNode gets the constant node for the value, create the node if it
+doesn't exist. The node is named by the shortest representation of the value,
+so constants spelled differently in the source file share the same node.
+*/
+func (g *Graph) GetConstantNode(value float64) *Node {
+	name := "CON" + strconv.FormatFloat(value, 'g', -1, 64)
+
+	node, exist := g.constantNodes[name]
+	if !exist {
+		node = CreateNode(name, NodeKind_Constant, NodeOp_Equal)
+		node.value = value
+
+		g.allNodes[name] = node
+		g.constantNodes[name] = node
+
+		g.isLevelized = false
+	}
+
+	return node
 }
 
 /*
@@ -204,60 +322,173 @@ func (g *Graph) DeleteNodeByName(name string) {
 }
 
 /*
-DeleteUnusedNodes deletes nodes with no fanin and no fanout.
+DeleteUnusedNodes deletes nodes with no fanin and no fanout, and returns the
+number of deleted nodes.
 */
-func (g *Graph) DeleteUnusedNodes() {
+func (g *Graph) DeleteUnusedNodes() int {
+	numDeleted := 0
+
 	for name, node := range g.allNodes {
 		if node.NumFanins() == 0 && node.NumFanouts() == 0 {
 			g.DeleteNodeByName(name)
+			numDeleted++
+		}
+	}
+
+	return numDeleted
+}
+
+/*
+numLocalFanouts returns the number of fanouts of a node that are in the graph. A
+node unified by MergeShared() is shared by multiple graphs, and also has
+fanouts in the other graphs.
+*/
+func (g *Graph) numLocalFanouts(n *Node) int {
+	num := 0
+
+	for _, fo := range n.fanouts {
+		if g.allNodes[fo.name] == fo {
+			num++
 		}
 	}
+
+	return num
+}
+
+/*
+numOperations returns the number of operation nodes with the given operation.
+*/
+func (g *Graph) numOperations(op NodeOp) int {
+	num := 0
+
+	for _, node := range g.operationNodes {
+		if node.op == op {
+			num++
+		}
+	}
+
+	return num
 }
 
 // -----------------------------------------------------------------------------
 
 /*
-Levelize calculates the level of each node recursively. Input and constant nodes
-are at level 0.
+Levelize calculates the level of each node and returns the maximum level. Input
+and constant nodes are at level 0, every other node is one level above its
+highest fanin.
+
+Levelization is done iteratively in linear time, each node is visited once no
+matter how many fanouts share it. Besides the level, the reverse level (distance
+to the farthest node without fanout) and a topological order sorted by level are
+also computed, see ReverseLevel() and TopologicalOrder().
 */
 func (g *Graph) Levelize() int {
 	if g.isLevelized {
 		return g.maxLevel
 	}
 
-	// Reset graph maximum level
-	g.maxLevel = -1000
+	// Visit nodes in name order so that the topological order is deterministic
+	names := make([]string, 0, len(g.allNodes))
+	for name := range g.allNodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	g.cycleNode = nil
 
-	// Reset all node level
+	// Reset all node level, -1 means not visited yet
 	for _, node := range g.allNodes {
 		node.level = -1
+		node.revLevel = 0
 	}
 
-	var levelize func(n *Node)
-	levelize = func(n *Node) {
-		if n.kind == NodeKind_Input || n.kind == NodeKind_Constant {
-			n.level = 0
-		} else {
-			max := -1000
+	// Depth-first traversal toward fanins with an explicit stack, a node is
+	// appended to the post order after all its fanins are appended
+	postOrder := make([]*Node, 0, len(g.allNodes))
 
-			for _, fi := range n.fanins {
-				levelize(fi)
+	type frame struct {
+		node    *Node
+		faninId int
+	}
+	stack := []frame{}
 
-				if fi.level > max {
-					max = fi.level
+	for _, name := range names {
+		if g.allNodes[name].level >= 0 {
+			continue
+		}
+
+		stack = append(stack, frame{g.allNodes[name], 0})
+		// Mark the node as in progress
+		g.allNodes[name].level = -2
+
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			n := top.node
+
+			if top.faninId < n.NumFanins() {
+				fi := n.Fanin(top.faninId)
+				top.faninId++
+
+				switch fi.level {
+				case -1:
+					fi.level = -2
+					stack = append(stack, frame{fi, 0})
+				case -2:
+					// The fanin is still in progress, so there's a cycle
+					g.cycleNode = fi
 				}
+
+				continue
 			}
 
-			n.level = max + 1
+			// All fanins are levelized, now levelize this node
+			n.level = 0
+			if n.kind != NodeKind_Input && n.kind != NodeKind_Constant {
+				for _, fi := range n.fanins {
+					if fi.level+1 > n.level {
+						n.level = fi.level + 1
+					}
+				}
+			}
+
+			postOrder = append(postOrder, n)
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	// Calculate reverse levels by walking the post order backward, a node is
+	// visited only after all its fanouts are visited
+	for i := len(postOrder) - 1; i >= 0; i-- {
+		n := postOrder[i]
 
-			if n.level > g.maxLevel {
-				g.maxLevel = n.level
+		for _, fi := range n.fanins {
+			if n.revLevel+1 > fi.revLevel {
+				fi.revLevel = n.revLevel + 1
 			}
 		}
 	}
 
-	for _, node := range g.outputNodes {
-		levelize(node)
+	// Sort the post order by level with counting sort, the result is still a
+	// topological order because a node's level is higher than its fanins'
+	g.maxLevel = 0
+	for _, n := range postOrder {
+		if n.level > g.maxLevel {
+			g.maxLevel = n.level
+		}
+	}
+
+	levelStarts := make([]int, g.maxLevel+2)
+	for _, n := range postOrder {
+		levelStarts[n.level+1]++
+	}
+	for l := 1; l < len(levelStarts); l++ {
+		levelStarts[l] += levelStarts[l-1]
+	}
+
+	g.topoOrder = make([]*Node, len(postOrder))
+	for _, n := range postOrder {
+		g.topoOrder[levelStarts[n.level]] = n
+		levelStarts[n.level]++
 	}
 
 	g.isLevelized = true
@@ -265,83 +496,80 @@ func (g *Graph) Levelize() int {
 	return g.maxLevel
 }
 
+/*
+ReverseLevel levelizes the graph if necessary and returns the reverse level of
+the node, which is the longest distance from the node to a node without fanout.
+*/
+func (g *Graph) ReverseLevel(n *Node) int {
+	g.Levelize()
+
+	return n.revLevel
+}
+
+/*
+TopologicalOrder levelizes the graph if necessary and returns all nodes sorted
+by their level, so every node comes after all its fanins.
+
+The returned slice is not updated when the graph structure is modified, so it
+is safe to delete nodes while iterating over it.
+*/
+func (g *Graph) TopologicalOrder() []*Node {
+	g.Levelize()
+
+	return g.topoOrder
+}
+
 // -----------------------------------------------------------------------------
 
 /*
 Eval evaluates all nodes' value. The graph is first levelized and then nodes are
 evaluated starting from the lowest level.
 */
-func (g *Graph) Eval() {
-	g.Levelize()
-
-	pq := CreateNodePQ()
-	for _, n := range g.operationNodes {
-		pq.Push(NodePQEntry{n, n.level})
-	}
-	for _, n := range g.outputNodes {
-		pq.Push(NodePQEntry{n, n.level})
+func (g *Graph) Eval() error {
+	for _, node := range g.TopologicalOrder() {
+		if node.kind == NodeKind_Operation || node.kind == NodeKind_Output {
+			if err := node.Eval(); err != nil {
+				return err
+			}
+		}
 	}
 
-	for pq.Len() > 0 {
-		node := pq.Pop()
-		node.Eval()
-	}
+	return nil
 }
 
 // -----------------------------------------------------------------------------
 
+/*
+Analyze prints a summary of the graph statistics, see Stats().
+*/
 func (g *Graph) Analyze() {
-	g.Levelize()
+	stats := g.Stats()
 
-	fmt.Printf(" %d operation nodes, %d levels\n", g.NumOperationNodes(), g.maxLevel)
+	fmt.Printf(" %d operation nodes, %d levels\n", g.NumOperationNodes(), stats.Depth)
 
-	// Fanout number statistics
-	fanoutCounter := [1000]int{}
-	for _, node := range g.operationNodes {
-		numFanouts := 0
-
-		for _, fo := range node.fanouts {
-			if fo.kind != NodeKind_Output {
-				numFanouts++
+	printDistribution := func(title string, distribution map[int]int) {
+		keys := []int{}
+		for key := range distribution {
+			if key > 0 {
+				keys = append(keys, key)
 			}
 		}
+		sort.Ints(keys)
 
-		fanoutCounter[numFanouts]++
-	}
-	fmt.Printf(" Fanout statistics: ")
-	for i := 1; i < 1000; i++ {
-		if fanoutCounter[i] > 0 {
-			fmt.Printf("%d=%d ", i, fanoutCounter[i])
+		fmt.Printf(" %s: ", title)
+		for _, key := range keys {
+			fmt.Printf("%d=%d ", key, distribution[key])
 		}
+		fmt.Printf("\n")
 	}
-	fmt.Printf("\n")
 
+	// Fanout number statistics
+	printDistribution("Fanout statistics", stats.FanoutDistribution)
 	// Fanout level difference statistics
-	fanoutLevelDiff := map[*Node]int{}
-	fanoutLevelDiffCounter := [1000]int{}
-	for _, node := range g.operationNodes {
-		minFoLevel := 100
-		maxFoLevel := -100
-		for _, fo := range node.fanouts {
-			if fo.level < minFoLevel {
-				minFoLevel = fo.level
-			}
-			if fo.level > maxFoLevel {
-				maxFoLevel = fo.level
-			}
-		}
-		fanoutLevelDiff[node] = maxFoLevel - minFoLevel
-	}
-	for _, diff := range fanoutLevelDiff {
-		fanoutLevelDiffCounter[diff]++
-	}
-	fmt.Printf(" Fanout level difference statistics: ")
-	for i := 1; i < 1000; i++ {
-		if fanoutLevelDiffCounter[i] > 0 {
-			fmt.Printf("%d=%d ", i, fanoutLevelDiffCounter[i])
-		}
-	}
-	fmt.Printf("\n")
+	printDistribution("Fanout level difference statistics", stats.FanoutLevelDiffDistribution)
+
+	fmt.Printf(" %d unabsorbed signs, %d negated outputs\n",
+		stats.NumUnabsorbedSigns, len(stats.NegatedOutputs))
 }
 
 // -----------------------------------------------------------------------------
@@ -350,47 +578,51 @@ func (g *Graph) Analyze() {
 AddPostfix adds a postfix to every node in the graph.
 */
 func (g *Graph) AddPostfix(postfix string) {
+	g.AddPostfixExcept(postfix, nil)
+}
+
+/*
+AddPostfixExcept adds a postfix to every node in the graph except the nodes for
+which keep returns true. A nil keep adds the postfix to every node.
+*/
+func (g *Graph) AddPostfixExcept(postfix string, keep func(n *Node) bool) {
 	newAllNodes := make(map[string]*Node)
-	for name, node := range g.allNodes {
-		node.name = node.name + "_" + postfix
-		newAllNodes[name+"_"+postfix] = node
+	for _, node := range g.allNodes {
+		if keep == nil || !keep(node) {
+			node.name = node.name + "_" + postfix
+		}
+		newAllNodes[node.name] = node
 	}
 	g.allNodes = newAllNodes
 
-	newInputNodes := make(map[string]*Node)
-	for name, node := range g.inputNodes {
-		newInputNodes[name+"_"+postfix] = node
-	}
-	g.inputNodes = newInputNodes
-
-	newOutputNodes := make(map[string]*Node)
-	for name, node := range g.outputNodes {
-		newOutputNodes[name+"_"+postfix] = node
-	}
-	g.outputNodes = newOutputNodes
-
-	newOperationNodes := make(map[string]*Node)
-	for name, node := range g.operationNodes {
-		newOperationNodes[name+"_"+postfix] = node
+	rename := func(nodes map[string]*Node) map[string]*Node {
+		newNodes := make(map[string]*Node)
+		for _, node := range nodes {
+			newNodes[node.name] = node
+		}
+		return newNodes
 	}
-	g.operationNodes = newOperationNodes
 
-	newConstantNodes := make(map[string]*Node)
-	for name, node := range g.constantNodes {
-		newConstantNodes[name+"_"+postfix] = node
-	}
-	g.constantNodes = newConstantNodes
+	g.inputNodes = rename(g.inputNodes)
+	g.outputNodes = rename(g.outputNodes)
+	g.operationNodes = rename(g.operationNodes)
+	g.constantNodes = rename(g.constantNodes)
 }
 
 /*
 Merge merges another graph with this graph.
+
+Node names must be unique across the two graphs (see AddPostfix()), otherwise an
+error is returned and this graph is left unchanged.
 */
-func (g *Graph) Merge(m *Graph) {
-	for name, node := range m.allNodes {
+func (g *Graph) Merge(m *Graph) error {
+	for name := range m.allNodes {
 		if _, exist := g.allNodes[name]; exist {
-			fmt.Printf("ERROR: node with same name exists.")
+			return fmt.Errorf("node %s exists in both graphs", name)
 		}
+	}
 
+	for name, node := range m.allNodes {
 		g.allNodes[name] = node
 	}
 
@@ -409,4 +641,155 @@ func (g *Graph) Merge(m *Graph) {
 	for name, node := range m.constantNodes {
 		g.constantNodes[name] = node
 	}
+
+	g.isLevelized = false
+
+	return nil
+}
+
+/*
+MergeShared merges another graph with this graph like Merge(), except that input
+nodes with the same name and constant nodes with the same value are unified
+instead of being reported as duplicates.
+
+Fanouts of a unified node in m are moved to the node in this graph, and m refers
+to the node in this graph afterward, so both graphs share the same node.
+*/
+func (g *Graph) MergeShared(m *Graph) error {
+	// Constants are unified by value so that differently spelled literals of the
+	// same value are also shared
+	constants := make(map[float64]*Node)
+	for _, node := range g.constantNodes {
+		constants[node.value] = node
+	}
+
+	shared := make(map[*Node]*Node)
+	for name, node := range m.allNodes {
+		switch node.kind {
+		case NodeKind_Input:
+			if gNode, exist := g.inputNodes[name]; exist {
+				shared[node] = gNode
+				continue
+			}
+		case NodeKind_Constant:
+			if gNode, exist := constants[node.value]; exist {
+				shared[node] = gNode
+				continue
+			}
+		}
+
+		if _, exist := g.allNodes[name]; exist {
+			return fmt.Errorf("node %s exists in both graphs", name)
+		}
+	}
+
+	for mNode, gNode := range shared {
+		for _, fo := range mNode.fanouts {
+			fo.ReplaceFanin(mNode, gNode)
+			gNode.AddFanout(fo)
+		}
+		mNode.fanouts = nil
+
+		m.DeleteNodeByName(mNode.name)
+
+		m.allNodes[gNode.name] = gNode
+		if gNode.kind == NodeKind_Input {
+			m.inputNodes[gNode.name] = gNode
+		} else {
+			m.constantNodes[gNode.name] = gNode
+		}
+	}
+
+	for name, node := range m.allNodes {
+		if _, exist := g.allNodes[name]; !exist {
+			g.allNodes[name] = node
+
+			switch node.kind {
+			case NodeKind_Input:
+				g.inputNodes[name] = node
+			case NodeKind_Output:
+				g.outputNodes[name] = node
+			case NodeKind_Operation:
+				g.operationNodes[name] = node
+			case NodeKind_Constant:
+				g.constantNodes[name] = node
+			}
+		}
+	}
+
+	g.isLevelized = false
+
+	return nil
+}
+
+/*
+ExtractOutputs returns a new graph that contains only the given output nodes and
+their transitive fanin cones. The nodes are copied so the two graphs can be
+transformed independently.
+*/
+func (g *Graph) ExtractOutputs(names []string) (*Graph, error) {
+	e := CreateGraph()
+	e.nextOperationId = g.nextOperationId
+
+	// Mark nodes in the cones of the selected outputs
+	inCone := make(map[*Node]bool)
+	for _, name := range names {
+		output, exist := g.outputNodes[name]
+		if !exist {
+			return nil, fmt.Errorf("output node %s does not exist", name)
+		}
+
+		inCone[output] = true
+		for _, node := range g.transitiveFanins(output) {
+			inCone[node] = true
+		}
+	}
+
+	// Copy nodes in topological order so fanins are copied before their fanouts
+	copies := make(map[*Node]*Node)
+	for _, node := range g.TopologicalOrder() {
+		if !inCone[node] {
+			continue
+		}
+
+		newNode := CreateNode(node.name, node.kind, node.op)
+		newNode.value = node.value
+
+		for i, fi := range node.fanins {
+			newNode.Receive(copies[fi])
+			newNode.faninSigns[i] = node.faninSigns[i]
+		}
+
+		copies[node] = newNode
+
+		e.allNodes[node.name] = newNode
+		switch node.kind {
+		case NodeKind_Input:
+			e.inputNodes[node.name] = newNode
+		case NodeKind_Output:
+			e.outputNodes[node.name] = newNode
+		case NodeKind_Operation:
+			e.operationNodes[node.name] = newNode
+		case NodeKind_Constant:
+			e.constantNodes[node.name] = newNode
+		}
+	}
+
+	// Keep the golden values of the remaining inputs and outputs
+	e.evalOptions = g.evalOptions
+	for set := range g.inputValues {
+		inputValues := make(map[string]float64)
+		for name := range e.inputNodes {
+			inputValues[name] = g.inputValues[set][name]
+		}
+		e.inputValues = append(e.inputValues, inputValues)
+
+		outputValues := make(map[string]float64)
+		for name := range e.outputNodes {
+			outputValues[name] = g.outputValues[set][name]
+		}
+		e.outputValues = append(e.outputValues, outputValues)
+	}
+
+	return e, nil
 }
@@ -7,62 +7,323 @@ import (
 )
 
 /*
-EvaluateGolden creates a number of sets of random input values, evaluates the
-graph using these input values, and records the output values as the golden result.
+InputDistribution represents how random input values are drawn when evaluating
+a graph.
 */
-func (g *Graph) EvaluateGolden(numSets int) {
-	g.Levelize()
+type InputDistribution int
+
+const (
+	// Uniformly distributed in [Low, High)
+	InputDistribution_Uniform InputDistribution = iota
+	// Normally distributed with mean (Low+High)/2 and standard deviation
+	// (High-Low)/2
+	InputDistribution_Normal
+	// Logarithm uniformly distributed in [log(Low), log(High)), so magnitudes
+	// of different orders are equally likely, Low must be positive
+	InputDistribution_LogUniform
+)
+
+/*
+InputDistributionLUT is a lookup table for converting a string to an
+InputDistribution.
+*/
+var InputDistributionLUT = map[string]InputDistribution{
+	"uniform":    InputDistribution_Uniform,
+	"normal":     InputDistribution_Normal,
+	"loguniform": InputDistribution_LogUniform,
+}
+
+/*
+EvalOptions controls how golden results are created and compared, see
+EvaluateGolden() and EvaluateCompare().
+
+An output value matches its golden value if it's within any of the tolerances,
+a tolerance of 0 only accepts exactly equal values.
+*/
+type EvalOptions struct {
+	// Seed of the random number generator, the same seed gives the same inputs
+	Seed int64
+	// Number of sets of random input values
+	NumSets int
+
+	Distribution InputDistribution
+	Low, High    float64
+
+	// Maximum number of representable float64 values between the values
+	MaxULP uint64
+	// Maximum difference relative to the magnitude of the golden value
+	RelTolerance float64
+	// Maximum absolute difference
+	AbsTolerance float64
+}
 
-	g.inputValues = make([]map[string]float64, numSets)
-	g.outputValues = make([]map[string]float64, numSets)
+/*
+DefaultEvalOptions returns the options of a few sets of inputs in [0, 1) and
+tolerances for rounding errors of reassociated operations.
+*/
+func DefaultEvalOptions() EvalOptions {
+	return EvalOptions{
+		Seed:         1,
+		NumSets:      4,
+		Distribution: InputDistribution_Uniform,
+		Low:          0,
+		High:         1,
+		MaxULP:       16,
+		RelTolerance: 1e-9,
+		AbsTolerance: 1e-12,
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+EvaluateGolden creates sets of random input values, evaluates the graph using
+these input values, and records the output values as the golden result.
+*/
+func (g *Graph) EvaluateGolden(options EvalOptions) error {
+	if options.Distribution == InputDistribution_LogUniform && options.Low <= 0 {
+		return fmt.Errorf("log-uniform inputs need a positive lower bound, got %v", options.Low)
+	}
+	if options.High < options.Low {
+		return fmt.Errorf("invalid input range [%v, %v)", options.Low, options.High)
+	}
+
+	inputs := g.orderedInputNodes()
+	r := rand.New(rand.NewSource(options.Seed))
 
-	for set := 0; set < numSets; set++ {
+	g.evalOptions = options
+	g.inputValues = make([]map[string]float64, options.NumSets)
+	g.outputValues = make([]map[string]float64, options.NumSets)
+
+	for set := 0; set < options.NumSets; set++ {
 		g.inputValues[set] = make(map[string]float64, g.NumInputNodes())
 		g.outputValues[set] = make(map[string]float64, g.NumOutputNodes())
 
-		for name, node := range g.inputNodes {
-			g.inputValues[set][name] = rand.Float64()
-			node.value = g.inputValues[set][name]
+		for _, node := range inputs {
+			g.inputValues[set][node.name] = options.randomValue(r)
+			node.value = g.inputValues[set][node.name]
 		}
 
-		g.Eval()
+		if err := g.Eval(); err != nil {
+			return err
+		}
 
 		for name, node := range g.outputNodes {
 			g.outputValues[set][name] = node.value
 		}
 	}
+
+	return nil
 }
 
 /*
 EvaluateCompare uses the store input values to evaluate the graph, and compares
-the output values against the golden result.
+the output values against the golden result using the tolerances given to
+EvaluateGolden().
 
 This function is used to verify that a graph retains the same functionality after
-some graph transformation.
+some graph transformation. An error describing the first mismatch is returned if
+any output differs from the golden result.
 */
-func (g *Graph) EvaluateCompare() {
+func (g *Graph) EvaluateCompare() error {
 	g.Levelize()
 
+	numMismatches := 0
+	var firstMismatch string
+
 	for set := 0; set < len(g.inputValues); set++ {
 		for name, node := range g.inputNodes {
 			node.value = g.inputValues[set][name]
 		}
 
-		g.Eval()
+		if err := g.Eval(); err != nil {
+			return err
+		}
 
-		for name, node := range g.outputNodes {
+		for _, node := range g.sortedOutputNodes() {
 			result := node.value
-			golden := g.outputValues[set][name]
+			golden, ok := g.outputValues[set][node.name]
+			if !ok {
+				return fmt.Errorf("no golden value for output %s", node.name)
+			}
+
+			if !g.evalOptions.matches(result, golden) {
+				if numMismatches == 0 {
+					firstMismatch = fmt.Sprintf("set %d, node %s, %v != %v",
+						set, node.name, result, golden)
+				}
+				numMismatches++
+			}
+		}
+	}
+
+	if numMismatches > 0 {
+		return fmt.Errorf("%d mismatches, first at %s", numMismatches, firstMismatch)
+	}
+
+	return nil
+}
+
+/*
+OutputErrors evaluates the graph using the stored input values, and returns the
+worst relative error of each output over all sets against the golden result.
+
+The golden result is usually evaluated on the unoptimized graph, so this
+measures the rounding errors introduced by optimizations. The absolute error is
+used where the golden value is 0, and sets where the golden value is NaN are
+skipped.
+*/
+func (g *Graph) OutputErrors() (map[string]float64, error) {
+	g.Levelize()
+
+	worstErrors := make(map[string]float64, g.NumOutputNodes())
+
+	for set := 0; set < len(g.inputValues); set++ {
+		for name, node := range g.inputNodes {
+			node.value = g.inputValues[set][name]
+		}
+
+		if err := g.Eval(); err != nil {
+			return nil, err
+		}
 
-			diffAbs := math.Abs(result - golden)
-			diffRel := math.Abs(diffAbs / golden)
+		for name, node := range g.outputNodes {
+			golden, ok := g.outputValues[set][name]
+			if !ok {
+				return nil, fmt.Errorf("no golden value for output %s", name)
+			}
+			if math.IsNaN(golden) {
+				continue
+			}
 
-			// Mismatch if the absolute value differs by 0.01 and the relative value
-			// differs by 1%
-			if diffAbs > 0.01 && diffRel > 0.01 {
-				fmt.Printf("Mismatch, set %d, node %s, %f != %f\n",
-					set, node.name, result, golden)
+			diff := math.Abs(node.value - golden)
+			if golden != 0 && !math.IsInf(golden, 0) {
+				diff /= math.Abs(golden)
+			} else if node.value == golden || math.IsInf(node.value, 0) {
+				diff = 0
 			}
+
+			if diff > worstErrors[name] || math.IsNaN(diff) {
+				worstErrors[name] = diff
+			}
+		}
+	}
+
+	return worstErrors, nil
+}
+
+/*
+sampleValues evaluates the graph with sets of random input values drawn like
+EvaluateGolden(), and returns the value of every node in each set. The golden
+result is not changed.
+*/
+func (g *Graph) sampleValues(options EvalOptions) (map[*Node][]float64, error) {
+	inputs := g.orderedInputNodes()
+	r := rand.New(rand.NewSource(options.Seed))
+
+	values := make(map[*Node][]float64, len(g.allNodes))
+	for _, node := range g.allNodes {
+		values[node] = make([]float64, options.NumSets)
+	}
+
+	for set := 0; set < options.NumSets; set++ {
+		for _, node := range inputs {
+			node.value = options.randomValue(r)
+		}
+
+		if err := g.Eval(); err != nil {
+			return nil, err
+		}
+
+		for node, nodeValues := range values {
+			nodeValues[set] = node.value
+		}
+	}
+
+	return values, nil
+}
+
+/*
+orderedInputNodes returns input nodes in a deterministic order, so that the same
+seed gives the same input values.
+*/
+func (g *Graph) orderedInputNodes() []*Node {
+	g.Levelize()
+
+	inputs := []*Node{}
+	for _, node := range g.TopologicalOrder() {
+		if node.kind == NodeKind_Input {
+			inputs = append(inputs, node)
 		}
 	}
+
+	return inputs
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+randomValue draws a random input value.
+*/
+func (o EvalOptions) randomValue(r *rand.Rand) float64 {
+	switch o.Distribution {
+	case InputDistribution_Normal:
+		return (o.Low+o.High)/2 + r.NormFloat64()*(o.High-o.Low)/2
+	case InputDistribution_LogUniform:
+		return math.Exp(math.Log(o.Low) + r.Float64()*(math.Log(o.High)-math.Log(o.Low)))
+	}
+
+	return o.Low + r.Float64()*(o.High-o.Low)
+}
+
+/*
+matches checks if a value is within any of the tolerances of the golden value.
+*/
+func (o EvalOptions) matches(value, golden float64) bool {
+	// A NaN golden value means the output is undefined for the inputs, for
+	// example square root of a negative input, and simplifications such as x*0
+	// to 0 may well give a number instead
+	if math.IsNaN(golden) {
+		return true
+	}
+	if math.IsNaN(value) {
+		return false
+	}
+	if value == golden {
+		return true
+	}
+	// Signs of infinities are not compared, because simplifications such as x-x
+	// to 0 don't retain the sign of a zero divisor
+	if math.IsInf(value, 0) || math.IsInf(golden, 0) {
+		return math.IsInf(value, 0) && math.IsInf(golden, 0)
+	}
+
+	diffAbs := math.Abs(value - golden)
+
+	return ulpDistance(value, golden) <= o.MaxULP ||
+		diffAbs <= o.RelTolerance*math.Abs(golden) ||
+		diffAbs <= o.AbsTolerance
+}
+
+/*
+ulpDistance returns the number of representable float64 values between two
+finite values.
+*/
+func ulpDistance(a, b float64) uint64 {
+	// Map the sign-magnitude representation to integers in the same order as the
+	// values, so that adjacent values differ by 1
+	ordered := func(x float64) int64 {
+		i := int64(math.Float64bits(x))
+		if i < 0 {
+			i = math.MinInt64 - i
+		}
+		return i
+	}
+
+	ia, ib := ordered(a), ordered(b)
+	if ia > ib {
+		return uint64(ia) - uint64(ib)
+	}
+
+	return uint64(ib) - uint64(ia)
 }
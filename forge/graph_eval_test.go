@@ -0,0 +1,206 @@
+package forge
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateCompare(t *testing.T) {
+	g := CreateGraph()
+	mul := addOperation(t, g, "*", getNode(t, g, "ARRx[0]"), getNode(t, g, "ARRx[1]"))
+	getNode(t, g, "ARRy[0]").Receive(mul)
+	if err := g.Legalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.EvaluateGolden(DefaultEvalOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.EvaluateCompare(); err != nil {
+		t.Errorf("unchanged graph mismatches: %v", err)
+	}
+
+	// Inputs are in [0, 1), so their sum is always larger than their product
+	mul.op = NodeOp_Add
+	err := g.EvaluateCompare()
+	if err == nil {
+		t.Fatal("no error after changing the operation")
+	}
+	if !strings.Contains(err.Error(), "mismatches") || !strings.Contains(err.Error(), "ARRy[0]") {
+		t.Errorf("error %q doesn't describe the mismatches", err)
+	}
+
+	// An operation that can't be evaluated is an error, not a mismatch
+	mul.op = NodeOp_Sub
+	if err := g.EvaluateCompare(); err == nil || !strings.Contains(err.Error(), mul.name) {
+		t.Errorf("error %v doesn't name the subtraction node", err)
+	}
+}
+
+func TestUlpDistance(t *testing.T) {
+	one := math.Float64bits(1)
+	inf := math.Float64bits(math.Inf(1))
+
+	tests := []struct {
+		a, b float64
+		want uint64
+	}{
+		{1, 1, 0},
+		{1, math.Nextafter(1, 2), 1},
+		{math.Nextafter(1, 0), math.Nextafter(1, 2), 2},
+		{-1, math.Nextafter(-1, -2), 1},
+		// +0 and -0 are the same value, the smallest subnormals around them are
+		// adjacent across the sign change
+		{0, math.Copysign(0, -1), 0},
+		{math.SmallestNonzeroFloat64, -math.SmallestNonzeroFloat64, 2},
+		{math.SmallestNonzeroFloat64, math.Copysign(0, -1), 1},
+		{-1, 1, 2 * one},
+		{math.MaxFloat64, math.Inf(1), 1},
+		{math.Inf(-1), math.Inf(1), 2 * inf},
+	}
+
+	for _, test := range tests {
+		if got := ulpDistance(test.a, test.b); got != test.want {
+			t.Errorf("ulpDistance(%v, %v) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := ulpDistance(test.b, test.a); got != test.want {
+			t.Errorf("ulpDistance(%v, %v) = %d, want %d", test.b, test.a, got, test.want)
+		}
+	}
+
+	// NaNs are ordered beyond infinities, far from any finite value
+	if d := ulpDistance(math.NaN(), math.MaxFloat64); d <= 1<<51 {
+		t.Errorf("ulpDistance(NaN, MaxFloat64) = %d", d)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	// nextUlps returns the value n representable values above x
+	nextUlps := func(x float64, n int) float64 {
+		for i := 0; i < n; i++ {
+			x = math.Nextafter(x, math.Inf(1))
+		}
+		return x
+	}
+
+	ulp := EvalOptions{MaxULP: 16}
+	rel := EvalOptions{RelTolerance: 0.5}
+	abs := EvalOptions{AbsTolerance: 0.5}
+	exact := EvalOptions{}
+
+	tests := []struct {
+		options       EvalOptions
+		value, golden float64
+		want          bool
+	}{
+		{ulp, nextUlps(1, 16), 1, true},
+		{ulp, nextUlps(1, 17), 1, false},
+		{ulp, nextUlps(-math.SmallestNonzeroFloat64, 16), -math.SmallestNonzeroFloat64, true},
+		{ulp, 1e-300, 0, false},
+		{rel, 6, 4, true},
+		{rel, nextUlps(6, 1), 4, false},
+		{rel, 2, 4, true},
+		{rel, -2, -4, true},
+		{rel, 1e-300, 0, false},
+		{abs, 0.5, 0, true},
+		{abs, nextUlps(0.5, 1), 0, false},
+		{abs, 1000.5, 1000, true},
+		{exact, 1, 1, true},
+		{exact, 0, math.Copysign(0, -1), true},
+		{exact, nextUlps(1, 1), 1, false},
+		// A NaN golden value is undefined and matches anything, a NaN result of a
+		// defined value doesn't match
+		{exact, 1, math.NaN(), true},
+		{ulp, math.NaN(), 1, false},
+		{exact, math.Inf(-1), math.Inf(1), true},
+		{abs, math.MaxFloat64, math.Inf(1), false},
+	}
+
+	for _, test := range tests {
+		if got := test.options.matches(test.value, test.golden); got != test.want {
+			t.Errorf("%+v matches(%v, %v) = %v, want %v", test.options, test.value, test.golden, got, test.want)
+		}
+	}
+}
+
+func TestRandomValue(t *testing.T) {
+	const numSamples = 100000
+
+	tests := []struct {
+		options  EvalOptions
+		mean, sd float64
+	}{
+		// The standard deviation of a uniform distribution is its range/sqrt(12)
+		{EvalOptions{Distribution: InputDistribution_Uniform, Low: -2, High: 3}, 0.5, 5 / math.Sqrt(12)},
+		{EvalOptions{Distribution: InputDistribution_Normal, Low: -2, High: 3}, 0.5, 2.5},
+		// Logarithms of a log-uniform distribution are uniform
+		{EvalOptions{Distribution: InputDistribution_LogUniform, Low: 1e-3, High: 1e3}, 0, 6 * math.Ln10 / math.Sqrt(12)},
+	}
+
+	for _, test := range tests {
+		r := rand.New(rand.NewSource(1))
+
+		sum, sumSquares := 0.0, 0.0
+		for i := 0; i < numSamples; i++ {
+			x := test.options.randomValue(r)
+
+			if test.options.Distribution != InputDistribution_Normal && (x < test.options.Low || x >= test.options.High) {
+				t.Fatalf("%+v: %v is out of range", test.options, x)
+			}
+			if test.options.Distribution == InputDistribution_LogUniform {
+				x = math.Log(x)
+			}
+
+			sum += x
+			sumSquares += x * x
+		}
+
+		mean := sum / numSamples
+		sd := math.Sqrt(sumSquares/numSamples - mean*mean)
+
+		if math.Abs(mean-test.mean) > 0.02*test.sd || math.Abs(sd-test.sd) > 0.02*test.sd {
+			t.Errorf("%+v: got mean %v and standard deviation %v, want %v and %v",
+				test.options, mean, sd, test.mean, test.sd)
+		}
+	}
+}
+
+func TestEvaluateGoldenSeed(t *testing.T) {
+	g := CreateGraph()
+	add := addOperation(t, g, "+", getNode(t, g, "ARRx[0]"), getNode(t, g, "ARRx[1]"))
+	getNode(t, g, "ARRy[0]").Receive(add)
+	if err := g.Legalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	evaluate := func(seed int64) []map[string]float64 {
+		options := DefaultEvalOptions()
+		options.Seed = seed
+
+		if err := g.EvaluateGolden(options); err != nil {
+			t.Fatal(err)
+		}
+		return g.inputValues
+	}
+
+	first := evaluate(1)
+	if second := evaluate(1); !reflect.DeepEqual(first, second) {
+		t.Errorf("seed 1 gave inputs %v and then %v", first, second)
+	}
+	if other := evaluate(2); reflect.DeepEqual(first, other) {
+		t.Errorf("seeds 1 and 2 gave the same inputs %v", first)
+	}
+
+	// Invalid ranges are errors
+	for _, options := range []EvalOptions{
+		{Distribution: InputDistribution_LogUniform, Low: 0, High: 1},
+		{Distribution: InputDistribution_Uniform, Low: 1, High: 0},
+	} {
+		if err := g.EvaluateGolden(options); err == nil {
+			t.Errorf("%+v: got no error", options)
+		}
+	}
+}
@@ -1,120 +1,994 @@
 package forge
 
-//import "fmt"
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+/*
+FoldConstants evaluates operations whose fanins are all constants and replaces
+them with constant nodes, then merges constant nodes having the same value.
+
+Operations are evaluated by Node.Eval() so fanin signs are honored. A negative
+result is stored as a positive constant with negated fanout edges, the same way
+negations are represented elsewhere in the graph. The number of folded
+operations is returned.
+*/
+func (g *Graph) FoldConstants() int {
+	numFolded := 0
+
+	// Merge duplicated constants first so that folded results can share them.
+	// GetConstantNode() may add canonical constants, so the constants are
+	// merged from a slice sorted by name rather than while ranging over the map.
+	constants := make([]*Node, 0, len(g.constantNodes))
+	for _, node := range g.constantNodes {
+		constants = append(constants, node)
+	}
+	sort.Slice(constants, func(i, j int) bool { return constants[i].name < constants[j].name })
+
+	for _, node := range constants {
+		canonical := g.GetConstantNode(node.value)
+
+		if canonical != node {
+			g.replaceNode(node, canonical, false)
+		}
+	}
+
+	// Visit operation nodes in topological order so that a folded operation
+	// becomes a constant fanin of its fanouts
+	for _, node := range g.TopologicalOrder() {
+		// A multi-output operation can't be replaced by a single constant
+		if node.kind != NodeKind_Operation || node.NumFanins() == 0 ||
+			node.op == NodeOp_SinCos {
+			continue
+		}
+
+		allConstant := true
+		for _, fi := range node.fanins {
+			if fi.kind != NodeKind_Constant {
+				allConstant = false
+				break
+			}
+		}
+		if !allConstant {
+			continue
+		}
+
+		// Leave unsupported or non-finite results to be computed by the hardware
+		if err := node.Eval(); err != nil ||
+			math.IsNaN(node.value) || math.IsInf(node.value, 0) {
+			continue
+		}
+
+		g.replaceNode(node, g.GetConstantNode(math.Abs(node.value)), node.value < 0)
+		numFolded++
+	}
+
+	// Delete constants that are no longer used
+	for name, node := range g.constantNodes {
+		if node.NumFanouts() == 0 {
+			g.DeleteNodeByName(name)
+		}
+	}
+
+	g.isLevelized = false
+
+	return numFolded
+}
 
 /*
 SimplifyArithmetic simplifies arithmetic operations to reduce the number of
 expensive operations such as multiplication and power.
+
+The following identities are applied, where fanin signs are taken into account
+so that the replacement carries the right sign to the fanouts
+
+	x+0 = x, x+(-x) = 0
+	x*1 = x, x*0 = 0
+	x/1 = x, x/x = 1
+	Power(x,1) = x, Power(x,0) = 1
+
+Signs of the remaining additions, multiplications and divisions are propagated
+toward their fanouts, which cancels double negations. The number of simplified
+operations is returned.
 */
-func (g *Graph) SimplifyArithmetic() {
-	for _, node := range g.operationNodes {
-		switch node.op {
-		case NodeOp_Mul:
-			var negateOutput bool = false
-			if node.GetFaninSignByIndex(0) != node.GetFaninSignByIndex(1) {
-				negateOutput = true
+func (g *Graph) SimplifyArithmetic() int {
+	numSimplified := 0
+
+	// Visit operation nodes in topological order so that a simplified operation
+	// can enable simplification of its fanouts
+	for _, node := range g.TopologicalOrder() {
+		if node.kind != NodeKind_Operation || node.NumFanins() != 2 {
+			continue
+		}
+
+		if replacement, negate, ok := g.simplifyOperation(node); ok {
+			g.replaceNode(node, replacement, negate)
+			numSimplified++
+		} else {
+			node.PropagateSign()
+		}
+	}
+
+	g.isLevelized = false
+
+	return numSimplified
+}
+
+/*
+CanonicalizeSigns moves signs toward adders, which absorb them for free, and
+returns the number of changes.
+
+Signs of all operations are propagated toward their fanouts in topological
+order, see Node.PropagateSign(). A sign that reaches an output is absorbed
+upstream if possible, for example -(a-b) becomes b-a, and -(a+b)*c becomes
+(-a-b)*c when a is a subtraction. The remaining negated outputs, which the host
+has to negate when reading them back, are returned by NegatedOutputs().
+*/
+func (g *Graph) CanonicalizeSigns() int {
+	numChanges := 0
+
+	for _, node := range g.TopologicalOrder() {
+		if node.kind == NodeKind_Operation && node.PropagateSign() {
+			numChanges++
+		}
+	}
+
+	for _, output := range g.sortedOutputNodes() {
+		if output.NumFanins() == 1 && output.GetFaninSignByIndex(0) &&
+			g.absorbNegation(output.Fanin(0)) {
+			output.NegateFaninByIndex(0)
+			numChanges++
+		}
+	}
+
+	return numChanges
+}
+
+/*
+absorbNegation negates the result of an operation by changing signs inside its
+single-fanout fanin cone, and returns false without changing anything if the
+negation can't be absorbed by an adder. The operation must have a single fanout
+so that no other node sees the change.
+*/
+func (g *Graph) absorbNegation(n *Node) bool {
+	if n.kind != NodeKind_Operation || n.NumFanouts() != 1 {
+		return false
+	}
+
+	switch n.op {
+	case NodeOp_Add:
+		// -(a-b) = b-a
+		if n.GetFaninSignByIndex(0) != n.GetFaninSignByIndex(1) {
+			n.NegateFaninByIndex(0)
+			n.NegateFaninByIndex(1)
+			return true
+		}
+
+		// -(a+b) = (-a)-b if a can be negated
+		for i := 0; i < 2; i++ {
+			if !n.GetFaninSignByIndex(i) && n.Fanin(0) != n.Fanin(1) && g.absorbNegation(n.Fanin(i)) {
+				n.NegateFaninByIndex(1 - i)
+				return true
 			}
+		}
+	case NodeOp_Mul, NodeOp_Div:
+		// -(a*b) = (-a)*b
+		return n.Fanin(0) != n.Fanin(1) &&
+			(g.absorbNegation(n.Fanin(0)) || g.absorbNegation(n.Fanin(1)))
+	case NodeOp_Sin:
+		// -sin(x) = sin(-x)
+		return g.absorbNegation(n.Fanin(0))
+	case NodeOp_Power:
+		// -Power(x,k) = Power(-x,k) for an odd k
+		exponent := n.Fanin(1)
+		return exponent.kind == NodeKind_Constant && math.Abs(math.Mod(exponent.value, 2)) == 1 &&
+			g.absorbNegation(n.Fanin(0))
+	}
 
-			for i, candidateConst := range node.fanins {
-				feedthrough := node.Fanin(1 - i)
+	return false
+}
 
-				if candidateConst.kind == NodeKind_Constant && candidateConst.value == 1 {
-					for _, fi := range node.fanins {
-						fi.RemoveFanout(node)
-					}
+/*
+NegatedOutputs returns the sorted names of output nodes whose fanin edge is
+negated, the host negates these outputs when reading them back.
+*/
+func (g *Graph) NegatedOutputs() []string {
+	names := []string{}
 
-					for _, fo := range node.fanouts {
-						feedthrough.AddFanout(fo)
-						fo.ReplaceFanin(node, feedthrough)
+	for _, output := range g.sortedOutputNodes() {
+		if output.NumFanins() == 1 && output.GetFaninSignByIndex(0) {
+			names = append(names, output.name)
+		}
+	}
 
-						if negateOutput {
-							fo.NegateFaninByNode(feedthrough)
-						}
-					}
+	return names
+}
 
-					g.DeleteNodeByName(node.name)
+/*
+simplifyOperation checks if a binary operation matches an algebraic identity.
+If it does, the node that replaces the operation is returned, together with
+whether the replacement needs to be negated.
+*/
+func (g *Graph) simplifyOperation(node *Node) (*Node, bool, bool) {
+	fi0, fi1 := node.Fanin(0), node.Fanin(1)
+	sign0, sign1 := node.GetFaninSignByIndex(0), node.GetFaninSignByIndex(1)
+
+	isConstant := func(n *Node, value float64) bool {
+		return n.kind == NodeKind_Constant && n.value == value
+	}
+
+	switch node.op {
+	case NodeOp_Add:
+		if isConstant(fi1, 0) {
+			return fi0, sign0, true
+		}
+		if isConstant(fi0, 0) {
+			return fi1, sign1, true
+		}
+		if fi0 == fi1 && sign0 != sign1 {
+			return g.GetConstantNode(0), false, true
+		}
+	case NodeOp_Mul:
+		if isConstant(fi0, 0) || isConstant(fi1, 0) {
+			return g.GetConstantNode(0), false, true
+		}
+		if isConstant(fi1, 1) {
+			return fi0, sign0 != sign1, true
+		}
+		if isConstant(fi0, 1) {
+			return fi1, sign0 != sign1, true
+		}
+	case NodeOp_Div:
+		if isConstant(fi1, 1) {
+			return fi0, sign0 != sign1, true
+		}
+		if fi0 == fi1 {
+			return g.GetConstantNode(1), sign0 != sign1, true
+		}
+	case NodeOp_Power:
+		if isConstant(fi1, 0) {
+			return g.GetConstantNode(1), false, true
+		}
+		if isConstant(fi1, 1) && !sign1 {
+			return fi0, sign0, true
+		}
+	}
+
+	return nil, false, false
+}
+
+/*
+ReducePower replaces power operations by cheaper operations, and returns the
+names of power operations that can't be replaced.
+
+A power with an integer exponent is replaced by a chain of multiplications
+following the shortest addition chain of the exponent, and intermediate powers
+of the same base are shared across the graph, for example x^2 computed for x^3
+is reused by x^4. A negative exponent becomes the reciprocal of the positive
+power. Exponents 0.5 and -0.5 become a square root and its reciprocal.
+
+Other exponents are lowered to exp(y*log(x)) if lowerExpLog is true, otherwise
+the power operations are left unchanged.
+*/
+func (g *Graph) ReducePower(lowerExpLog bool) []string {
+	// Powers already computed for each base, indexed by the exponent
+	powers := make(map[*Node]map[int]*Node)
+
+	// getPower returns a node computing base^exponent for a positive integer
+	// exponent, reusing and recording intermediate powers
+	getPower := func(base *Node, exponent int) *Node {
+		if _, exist := powers[base]; !exist {
+			powers[base] = map[int]*Node{1: base}
+		}
+
+		chain := additionChain(exponent)
+		for i := 1; i < len(chain); i++ {
+			if _, exist := powers[base][chain[i]]; exist {
+				continue
+			}
+
+			// In a star chain each element is the previous element plus an earlier
+			// element, find the earlier element
+			for j := 0; j < i; j++ {
+				if chain[i-1]+chain[j] == chain[i] {
+					mul := g.addOperationNode(NodeOp_Mul)
+					mul.Receive(powers[base][chain[i-1]])
+					mul.Receive(powers[base][chain[j]])
+
+					powers[base][chain[i]] = mul
 					break
 				}
 			}
 		}
+
+		return powers[base][exponent]
+	}
+
+	// getReciprocal returns a node computing 1/n
+	getReciprocal := func(n *Node) *Node {
+		div := g.addOperationNode(NodeOp_Div)
+		div.Receive(g.GetConstantNode(1))
+		div.Receive(n)
+
+		return div
+	}
+
+	unreduced := []string{}
+
+	for _, node := range g.TopologicalOrder() {
+		if node.kind != NodeKind_Operation || node.op != NodeOp_Power {
+			continue
+		}
+
+		base, exponentNode := node.Fanin(0), node.Fanin(1)
+		baseSign := node.GetFaninSignByIndex(0)
+
+		var replacement *Node
+		negate := false
+
+		exponent := exponentNode.value
+		if node.GetFaninSignByIndex(1) {
+			exponent = -exponent
+		}
+
+		switch {
+		case exponentNode.kind == NodeKind_Constant && exponent == 0:
+			replacement = g.GetConstantNode(1)
+		case exponentNode.kind == NodeKind_Constant &&
+			exponent == math.Trunc(exponent) && math.Abs(exponent) <= maxPowerExponent:
+			absExponent := int(math.Abs(exponent))
+
+			replacement = getPower(base, absExponent)
+			if exponent < 0 {
+				replacement = getReciprocal(replacement)
+			}
+
+			// An odd power of a negated base is negated
+			negate = baseSign && absExponent%2 == 1
+		case exponentNode.kind == NodeKind_Constant && math.Abs(exponent) == 0.5:
+			replacement = g.addOperationNode(NodeOp_Sqrt)
+			replacement.Receive(base)
+			if baseSign {
+				replacement.NegateFaninByIndex(0)
+			}
+
+			if exponent < 0 {
+				replacement = getReciprocal(replacement)
+			}
+		case lowerExpLog:
+			log := g.addOperationNode(NodeOp_Log)
+			log.Receive(base)
+			if baseSign {
+				log.NegateFaninByIndex(0)
+			}
+
+			mul := g.addOperationNode(NodeOp_Mul)
+			mul.Receive(exponentNode)
+			mul.Receive(log)
+			if node.GetFaninSignByIndex(1) {
+				mul.NegateFaninByIndex(0)
+			}
+
+			replacement = g.addOperationNode(NodeOp_Exp)
+			replacement.Receive(mul)
+		default:
+			unreduced = append(unreduced, node.name)
+			continue
+		}
+
+		g.replaceNode(node, replacement, negate)
 	}
 
 	g.isLevelized = false
+
+	return unreduced
 }
 
 /*
-EliminateDuplicatedOperation eliminates duplicated operations using value numbering.
+EliminateDuplicatedOperation eliminates duplicated operations using value numbering,
+and returns the number of eliminated operations.
 
 The graph must be levelized and value numbering needs to start from inputs,
 otherwise a duplicated operation will not be eliminated when its fanout is
 processed beforehand. (this happens if loop over a map because map is not ordered)
 
+The key of an operation is built from its fanins' value number and sign. Fanins
+of commutative operations are sorted, and signs are normalized so that an
+operation equal to the negation of an existing one is also eliminated, for
+example b-a is replaced by the negation of -b+a, and (-a)*b by the negation of
+a*b.
+
 See "Engineering a Compiler 2nd Edition, section 8.4.1".
 */
-func (g *Graph) EliminateDuplicatedOperation() {
-	// Levelize the graph
-	g.Levelize()
+func (g *Graph) EliminateDuplicatedOperation() int {
+	type operand struct {
+		vn   int
+		sign bool
+	}
+	type vnEntry struct {
+		node   *Node
+		negate bool
+	}
 
-	// Use a priority queue to sort operation nodes by level
-	pq := CreateNodePQ()
-	for _, node := range g.operationNodes {
-		pq.Push(NodePQEntry{node, node.level})
+	// Value numbers of nodes, a node that is not eliminated is its own value
+	valueNumbers := make(map[*Node]int)
+	getValueNumber := func(n *Node) int {
+		vn, exist := valueNumbers[n]
+		if !exist {
+			vn = len(valueNumbers)
+			valueNumbers[n] = vn
+		}
+		return vn
 	}
 
 	// This map acts as a hash holding value numbers
-	vnMap := make(map[string]*Node)
+	vnMap := make(map[string]vnEntry)
 
-	for pq.Len() > 0 {
-		node := pq.Pop()
+	numEliminated := 0
 
-		// Construct the value number for this operation
-		// Here we're not using fanin's value number but their name, this is
-		// sub-optimal but much easier
-		vnKey := NodeOpStringLUT[node.op]
+	// Visit operation nodes in topological order
+	for _, node := range g.TopologicalOrder() {
+		if node.kind != NodeKind_Operation {
+			continue
+		}
+
+		operands := make([]operand, node.NumFanins())
 		for i, fi := range node.fanins {
-			if node.GetFaninSignByIndex(i) {
+			operands[i] = operand{getValueNumber(fi), node.GetFaninSignByIndex(i)}
+		}
+
+		// Normalize operands, negate is true if the operation computes the
+		// negation of the normalized operation
+		negate := false
+
+		switch node.op {
+		case NodeOp_Add, NodeOp_Mul:
+			sort.Slice(operands, func(i, j int) bool {
+				return operands[i].vn < operands[j].vn ||
+					operands[i].vn == operands[j].vn && !operands[i].sign && operands[j].sign
+			})
+		}
+
+		switch node.op {
+		case NodeOp_Add:
+			// -a+b = -(a-b)
+			if operands[0].sign {
+				for i := range operands {
+					operands[i].sign = !operands[i].sign
+				}
+				negate = true
+			}
+		case NodeOp_Mul, NodeOp_Div:
+			// (-a)*b = -(a*b)
+			for i := range operands {
+				if operands[i].sign {
+					operands[i].sign = false
+					negate = !negate
+				}
+			}
+		}
+
+		// Construct the value number key for this operation
+		vnKey := NodeOpStringLUT[node.op]
+		for _, opd := range operands {
+			vnKey += ","
+			if opd.sign {
 				vnKey += "-"
 			}
-			vnKey += fi.name
+			vnKey += strconv.Itoa(opd.vn)
 		}
 
-		if vnNode, exist := vnMap[vnKey]; !exist {
+		if entry, exist := vnMap[vnKey]; !exist {
 			// Store the operation if it does not exist
-			vnMap[vnKey] = node
+			vnMap[vnKey] = vnEntry{node, negate}
 		} else {
 			// Otherwise replace the operation with the existing one
+			g.replaceNode(node, entry.node, negate != entry.negate)
+			numEliminated++
+		}
+	}
+
+	g.isLevelized = false
+
+	return numEliminated
+}
+
+/*
+FactorizeSums factors common operands out of sums of products to reduce the
+number of multiplications, for example a*b + a*c + a*d becomes a*(b+c+d), and
+returns the number of multiplications saved.
+
+Factors are picked greedily, the operand shared by the most products in a sum
+is factored out first. Only products used solely by the sum are factored so
+that no multiplication is duplicated.
+*/
+func (g *Graph) FactorizeSums() int {
+	type term struct {
+		node *Node
+		sign bool
+	}
+	type product struct {
+		term
+		factors [2]*Node
+	}
+
+	numSaved := 0
+
+	for _, root := range g.TopologicalOrder() {
+		if root.kind != NodeKind_Operation || root.op != NodeOp_Add ||
+			g.allNodes[root.name] != root {
+			continue
+		}
+		// Skip internal nodes of a sum, they are processed with the root
+		if root.NumFanouts() == 1 && root.Fanout(0).op == NodeOp_Add {
+			continue
+		}
+
+		// Flatten the sum into terms, signs of internal additions are distributed
+		// to their terms
+		terms := []term{}
+		internalNodes := []*Node{}
+
+		var flatten func(n *Node, sign bool)
+		flatten = func(n *Node, sign bool) {
+			for i, fi := range n.fanins {
+				fiSign := sign != n.GetFaninSignByIndex(i)
+
+				if fi.kind == NodeKind_Operation && fi.op == NodeOp_Add && fi.NumFanouts() == 1 {
+					internalNodes = append(internalNodes, fi)
+					flatten(fi, fiSign)
+				} else {
+					terms = append(terms, term{fi, fiSign})
+				}
+			}
+		}
+		flatten(root, false)
+
+		// Separate products from other terms, the sign of a product includes the
+		// signs of its factors
+		products := []product{}
+		otherTerms := []term{}
+		for _, t := range terms {
+			if t.node.kind == NodeKind_Operation && t.node.op == NodeOp_Mul && t.node.NumFanouts() == 1 {
+				sign := t.sign != t.node.GetFaninSignByIndex(0) != t.node.GetFaninSignByIndex(1)
+				products = append(products, product{term{t.node, sign}, [2]*Node{t.node.Fanin(0), t.node.Fanin(1)}})
+			} else {
+				otherTerms = append(otherTerms, t)
+			}
+		}
+
+		removedNodes := []*Node{}
+
+		for {
+			// Count how many products each factor appears in
+			counts := make(map[*Node]int)
+			for _, p := range products {
+				counts[p.factors[0]]++
+				if p.factors[1] != p.factors[0] {
+					counts[p.factors[1]]++
+				}
+			}
+
+			var factor *Node
+			for _, p := range products {
+				for _, f := range p.factors {
+					if counts[f] >= 2 && (factor == nil || counts[f] > counts[factor]) {
+						factor = f
+					}
+				}
+			}
+			if factor == nil {
+				break
+			}
+
+			// Sum up the cofactors of the products sharing the factor
+			var sum *Node
+			var sumSign bool
+			remainingProducts := []product{}
+
+			for _, p := range products {
+				if p.factors[0] != factor && p.factors[1] != factor {
+					remainingProducts = append(remainingProducts, p)
+					continue
+				}
+
+				cofactor := p.factors[0]
+				if cofactor == factor {
+					cofactor = p.factors[1]
+				}
+
+				if sum == nil {
+					sum, sumSign = cofactor, p.sign
+				} else {
+					add := g.addOperationNode(NodeOp_Add)
+					add.Receive(sum)
+					add.Receive(cofactor)
+					if sumSign {
+						add.NegateFaninByIndex(0)
+					}
+					if p.sign {
+						add.NegateFaninByIndex(1)
+					}
+
+					sum, sumSign = add, false
+					numSaved++
+				}
+
+				removedNodes = append(removedNodes, p.node)
+			}
+
+			mul := g.addOperationNode(NodeOp_Mul)
+			mul.Receive(factor)
+			mul.Receive(sum)
+			if sumSign {
+				mul.NegateFaninByIndex(1)
+			}
+
+			products = remainingProducts
+			otherTerms = append(otherTerms, term{mul, false})
+		}
+
+		if len(removedNodes) == 0 {
+			continue
+		}
+
+		// Rebuild the sum with the remaining terms and replace the root
+		for _, p := range products {
+			otherTerms = append(otherTerms, p.term)
+			// The sign of the product is now on the edge to the sum
+			if p.node.GetFaninSignByIndex(0) {
+				p.node.NegateFaninByIndex(0)
+			}
+			if p.node.GetFaninSignByIndex(1) {
+				p.node.NegateFaninByIndex(1)
+			}
+		}
+
+		newRoot, newRootSign := otherTerms[0].node, otherTerms[0].sign
+		for _, t := range otherTerms[1:] {
+			add := g.addOperationNode(NodeOp_Add)
+			add.Receive(newRoot)
+			add.Receive(t.node)
+			if newRootSign {
+				add.NegateFaninByIndex(0)
+			}
+			if t.sign {
+				add.NegateFaninByIndex(1)
+			}
+
+			newRoot, newRootSign = add, false
+		}
+
+		g.replaceNode(root, newRoot, newRootSign)
+
+		// Delete the old additions and the factored products
+		for _, node := range append(internalNodes, removedNodes...) {
 			for _, fi := range node.fanins {
 				fi.RemoveFanout(node)
 			}
+			g.DeleteNodeByName(node.name)
+		}
+	}
+
+	g.isLevelized = false
+
+	return numSaved
+}
 
-			for _, fo := range node.fanouts {
-				vnNode.AddFanout(fo)
-				fo.ReplaceFanin(node, vnNode)
+/*
+ShareReciprocals rewrites divisions into multiplications to relieve the divider,
+and returns the number of rewritten divisions.
+
+A division by a constant becomes a multiplication by the inverse of the constant
+if the inverse is exact, which is when the constant is a power of two, or for
+any constant if fastMath is true.
+
+If fastMath is true, a denominator used by multiple divisions is also inverted
+once and the divisions become multiplications by the shared reciprocal, which
+rounds differently. An existing 1/d is used as the shared reciprocal instead of
+being rewritten.
+*/
+func (g *Graph) ShareReciprocals(fastMath bool) int {
+	numRewritten := 0
+
+	// toMul rewrites a division into a multiplication by the reciprocal, the
+	// multiplier is negated if negate is true
+	toMul := func(div, reciprocal *Node, negate bool) {
+		denominator := div.Fanin(1)
+		denominator.RemoveFanout(div)
+
+		div.op = NodeOp_Mul
+		div.fanins[1] = reciprocal
+		div.faninSigns[1] = div.faninSigns[1] != negate
+		reciprocal.AddFanout(div)
+
+		numRewritten++
+	}
+
+	for _, node := range g.TopologicalOrder() {
+		if node.kind == NodeKind_Constant {
+			if node.value == 0 {
+				continue
 			}
 
-			g.DeleteNodeByName(node.name)
+			// Division by a constant
+			fraction, _ := math.Frexp(node.value)
+			if !fastMath && fraction != 0.5 {
+				continue
+			}
+
+			for _, div := range g.divisionsBy(node) {
+				toMul(div, g.GetConstantNode(1/node.value), false)
+			}
+		} else if fastMath {
+			// Division by a shared denominator
+			divs := g.divisionsBy(node)
+			if len(divs) < 2 {
+				continue
+			}
+
+			// Use an existing reciprocal, the divisions are then multiplied by
+			// its value with the signs of both denominators, and the sign of
+			// its numerator
+			var reciprocal *Node
+			negate := false
+			for i, div := range divs {
+				if numerator := div.Fanin(0); numerator.kind == NodeKind_Constant && numerator.value == 1 {
+					reciprocal = div
+					negate = div.GetFaninSignByIndex(0) != div.GetFaninSignByIndex(1)
+					divs = append(divs[:i], divs[i+1:]...)
+					break
+				}
+			}
+
+			if reciprocal == nil {
+				reciprocal = g.addOperationNode(NodeOp_Div)
+				reciprocal.Receive(g.GetConstantNode(1))
+				reciprocal.Receive(node)
+			}
+
+			for _, div := range divs {
+				toMul(div, reciprocal, negate)
+			}
 		}
 	}
 
 	g.isLevelized = false
+
+	return numRewritten
+}
+
+/*
+divisionsBy returns the divisions using the node as the denominator.
+*/
+func (g *Graph) divisionsBy(n *Node) []*Node {
+	divs := []*Node{}
+	// A fanout appears multiple times if it uses the node multiple times
+	found := make(map[*Node]bool)
+
+	for _, fo := range n.fanouts {
+		if fo.kind == NodeKind_Operation && fo.op == NodeOp_Div && fo.Fanin(1) == n && !found[fo] {
+			divs = append(divs, fo)
+			found[fo] = true
+		}
+	}
+
+	return divs
+}
+
+/*
+FuseSinCos fuses a sine and a cosine of the same argument into a sincos
+operation, which is computed by a CORDIC process element at once, and returns
+the number of fused pairs.
+
+The sine and cosine nodes are replaced by nodes selecting the corresponding
+output of the sincos operation. Signs of the argument are normalized, so sin(x)
+and cos(-x) are also fused, and sin(-x) becomes the negated sine output.
+*/
+func (g *Graph) FuseSinCos() int {
+	numFused := 0
+
+	for _, node := range g.TopologicalOrder() {
+		// Constant arguments are left to constant folding
+		if node.kind == NodeKind_Constant {
+			continue
+		}
+
+		// Sine and cosine fanouts of the node are fused regardless of the sign of
+		// their argument, since cos(-x) = cos(x) and sin(-x) = -sin(x)
+		sines := []*Node{}
+		cosines := []*Node{}
+
+		for _, fo := range node.fanouts {
+			if fo.kind != NodeKind_Operation || fo.NumFanins() != 1 {
+				continue
+			}
+
+			switch fo.op {
+			case NodeOp_Sin:
+				sines = append(sines, fo)
+			case NodeOp_Cos:
+				cosines = append(cosines, fo)
+			}
+		}
+
+		if len(sines) == 0 || len(cosines) == 0 {
+			continue
+		}
+
+		sinCos := g.addOperationNode(NodeOp_SinCos)
+		sinCos.Receive(node)
+
+		sin := g.addOperationNode(NodeOp_SinCosSin)
+		sin.Receive(sinCos)
+		for _, n := range sines {
+			// The sine of a negated argument is the negated sine output
+			g.replaceNode(n, sin, n.GetFaninSignByIndex(0))
+		}
+
+		cos := g.addOperationNode(NodeOp_SinCosCos)
+		cos.Receive(sinCos)
+		for _, n := range cosines {
+			g.replaceNode(n, cos, false)
+		}
+
+		numFused++
+	}
+
+	g.isLevelized = false
+
+	return numFused
+}
+
+/*
+EliminateDeadCode deletes every node whose result never reaches an output node,
+and returns the number of deleted nodes and the sorted names of deleted input
+nodes.
+
+Live nodes are marked by traversing fanins from the output nodes, then unmarked
+nodes are swept. Unlike DeleteUnusedNodes(), this deletes whole chains of
+operations that don't contribute to any output, together with the constants and
+inputs that only they use. Deleted inputs no longer need to be transferred to
+the accelerator.
+*/
+func (g *Graph) EliminateDeadCode() (int, []string) {
+	// Mark
+	live := make(map[*Node]bool, len(g.allNodes))
+
+	stack := make([]*Node, 0, len(g.outputNodes))
+	for _, node := range g.outputNodes {
+		live[node] = true
+		stack = append(stack, node)
+	}
+
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for _, fi := range node.fanins {
+			if !live[fi] {
+				live[fi] = true
+				stack = append(stack, fi)
+			}
+		}
+	}
+
+	// Sweep, dead nodes are disconnected from their live fanins, edges between
+	// dead nodes go away with the nodes
+	numDeleted := 0
+	deletedInputs := []string{}
+
+	for name, node := range g.allNodes {
+		if live[node] {
+			continue
+		}
+
+		for _, fi := range node.fanins {
+			fi.RemoveFanout(node)
+		}
+
+		if node.kind == NodeKind_Input {
+			deletedInputs = append(deletedInputs, name)
+		}
+
+		g.DeleteNodeByName(name)
+		numDeleted++
+	}
+
+	sort.Strings(deletedInputs)
+
+	return numDeleted, deletedInputs
 }
 
 /*
 MaximizeParallelism maximizes the possible parallelism by balancing tree heights
 in the graph in two phases.
 
-The first phase identifies candidate tree roots.
+The first phase identifies candidate tree roots of additions and multiplications.
 The second phase finds all the operands for a candidate tree and build a
 balanced tree for them.
 
+Signs are handled differently for the two operations. A negated addition
+distributes the negation to each of its operands, while a product is negated
+if an odd number of its operands are negated, so the overall sign of a
+multiplication tree is put on the first fanin of the root after rebalancing.
+
 See "Engineering a Compiler 2nd Edition, section 8.4.2".
 */
 func (g *Graph) MaximizeParallelism() {
+	g.maximizeParallelism(false, nil)
+}
+
+/*
+MaximizeParallelismByLatency balances trees like MaximizeParallelism(), except
+that operands are combined in the order of their estimated ready time instead of
+their rank.
+
+The ready time of a node is its as-soon-as-possible finish time using the
+process element latencies, so operands that are available early are combined
+first, and a tree is built like a Huffman tree to minimize its finish time.
+*/
+func (g *Graph) MaximizeParallelismByLatency() {
+	g.maximizeParallelism(true, nil)
+}
+
+/*
+MaximizeParallelismWithinError balances trees like MaximizeParallelism(), or
+MaximizeParallelismByLatency() if byLatency is true, except that addition trees
+whose reassociation may introduce a relative error above maxRelError are left
+as they are. The number of trees left unbalanced is returned.
+
+Summing n terms in any order has an error bounded by (n-1)*u*sum(|x|), where u
+is the unit roundoff, so the relative error of reassociating a sum is estimated
+as (n-1)*u times its condition number sum(|x|)/|sum(x)|. The condition number is
+sampled by evaluating the graph with random inputs, and the worst sample counts.
+Sums of large cancelling terms have large condition numbers. Products are always
+balanced because their relative error doesn't depend on the order.
+*/
+func (g *Graph) MaximizeParallelismWithinError(byLatency bool, maxRelError float64,
+	samples EvalOptions) (int, error) {
+	values, err := g.sampleValues(samples)
+	if err != nil {
+		return 0, fmt.Errorf("problem sampling node values: %v", err)
+	}
+
+	guard := &reassociationGuard{values: values, numSets: samples.NumSets, maxRelError: maxRelError}
+	g.maximizeParallelism(byLatency, guard)
+
+	return guard.numRefused, nil
+}
+
+/*
+reassociationGuard holds the sampled node values used to estimate the error of
+reassociating a sum, see MaximizeParallelismWithinError().
+*/
+type reassociationGuard struct {
+	values      map[*Node][]float64
+	numSets     int
+	maxRelError float64
+
+	numRefused int
+}
+
+// unitRoundoff is the maximum relative error of rounding a float64 result
+const unitRoundoff = 0x1p-53
+
+/*
+maximizeParallelism implements MaximizeParallelism(),
+MaximizeParallelismByLatency() and MaximizeParallelismWithinError(). Trees are
+not limited by their reassociation error if guard is nil.
+*/
+func (g *Graph) maximizeParallelism(byLatency bool, guard *reassociationGuard) {
 	// Phase 1 - analysis
 	// ---------------------------------------------------------------------------
 
 	// Sort candidate roots by their operation precedence
 	candidateRoots := CreateNodePQ()
+	isCandidateRoot := make(map[*Node]bool)
 
 	// Store nodes' rank, -1 means not processed yet
 	// A node's rank is used to build a balanced tree (approximately)
@@ -123,14 +997,40 @@ func (g *Graph) MaximizeParallelism() {
 		ranks[node] = -1
 	}
 
+	// Store nodes' estimated ready time, which is used instead of rank to build
+	// a tree when balancing by latency
+	readyTimes := make(map[*Node]int)
+	for _, node := range g.TopologicalOrder() {
+		readyTimes[node] = 0
+		for _, fi := range node.fanins {
+			if readyTimes[fi] > readyTimes[node] {
+				readyTimes[node] = readyTimes[fi]
+			}
+		}
+		readyTimes[node] += nodeOpLatency[node.op]
+	}
+
+	// priority returns the priority of a node as an operand
+	priority := func(n *Node) int {
+		if byLatency {
+			return readyTimes[n]
+		}
+		return ranks[n]
+	}
+
 	// Find candidate tree roots
 	for _, node := range g.operationNodes {
 		// A node is a candidate root if it has multiple fanouts or it's fanout has
 		// different operation than its own
 		if node.NumFanouts() > 1 ||
 			node.NumFanouts() == 1 && node.op != node.Fanout(0).op {
-			if node.op == NodeOp_Add {
+			switch node.op {
+			case NodeOp_Add:
 				candidateRoots.Push(NodePQEntry{node, 1}) // let add have precedence of 1
+				isCandidateRoot[node] = true
+			case NodeOp_Mul:
+				candidateRoots.Push(NodePQEntry{node, 2}) // let mul have precedence of 2
+				isCandidateRoot[node] = true
 			}
 		}
 	}
@@ -159,6 +1059,15 @@ func (g *Graph) MaximizeParallelism() {
 		// Store all the operands for the given root node
 		operandNodes := CreateNodePQ()
 		operandSigns := map[*Node]int{}
+		// Whether the product of a multiplication tree is negated
+		negateProduct := false
+		// Sampled sum of the operands of an addition tree, and sum of their
+		// magnitudes, used to estimate the reassociation error
+		var sums, absSums []float64
+		if guard != nil {
+			sums = make([]float64, guard.numSets)
+			absSums = make([]float64, guard.numSets)
+		}
 		// Collect all the operations along the traversal, and later on rebuild the
 		// tree using these nodes
 		operationNodes := []*Node{}
@@ -174,6 +1083,31 @@ func (g *Graph) MaximizeParallelism() {
 			rebuild(root)
 		}()
 
+		/*
+		   Add an operand with the sign of the edge it's connected to
+		*/
+		addOperand := func(n *Node, op NodeOp, sign bool) {
+			operandNodes.Push(NodePQEntry{n, priority(n)})
+
+			if guard != nil && op == NodeOp_Add {
+				for set, value := range guard.values[n] {
+					if sign {
+						value = -value
+					}
+					sums[set] += value
+					absSums[set] += math.Abs(value)
+				}
+			}
+
+			if sign {
+				if op == NodeOp_Mul {
+					negateProduct = !negateProduct
+				} else {
+					operandSigns[n]++
+				}
+			}
+		}
+
 		/*
 		   Find all operands for a sub-tree starting with node n
 		*/
@@ -184,33 +1118,32 @@ func (g *Graph) MaximizeParallelism() {
 
 			if ranks[n] >= 0 {
 				// This node is already processed, so it becomes an operand
-				operandNodes.Push(NodePQEntry{n, ranks[n]})
-				if sign {
-					operandSigns[n]++
-				}
+				addOperand(n, op, sign)
 			} else if n.kind == NodeKind_Constant {
 				// A constant has rank 0 and it's an operand
 				ranks[n] = 0
-				operandNodes.Push(NodePQEntry{n, ranks[n]})
-				if sign {
-					operandSigns[n]++
-				}
+				addOperand(n, op, sign)
+			} else if isCandidateRoot[n] {
+				// If the node is also a candidate tree root, build it recursively and
+				// it becomes an operand. This is checked before the boundary so that a
+				// tree of another operation is balanced first to get its rank.
+				balance(n)
+				addOperand(n, op, sign)
 			} else if n.kind == NodeKind_Input || n.op != op {
 				// Reach the boundary of the sub-tree, either input or a node with
 				// different operation, and it's an operand
 				ranks[n] = 1
-				operandNodes.Push(NodePQEntry{n, ranks[n]})
+				addOperand(n, op, sign)
+			} else if op == NodeOp_Mul {
+				// An internal node in a multiplication tree, its sign goes to the
+				// product instead of its operands
 				if sign {
-					operandSigns[n]++
-				}
-			} else if exist := candidateRoots.FindNode(n); exist {
-				// If the node is also a candidate tree root, build it recursively and
-				// it becomes an operand
-				balance(n)
-				operandNodes.Push(NodePQEntry{n, ranks[n]})
-				if sign {
-					operandSigns[n]++
+					negateProduct = !negateProduct
 				}
+
+				ranks[n] = flatten(n.Fanin(0), n.op, n.GetFaninSignByIndex(0), false) +
+					flatten(n.Fanin(1), n.op, n.GetFaninSignByIndex(1), false)
+				operationNodes = append(operationNodes, n)
 			} else {
 				// An internal node in a sub-tree, recursively find its operands
 				ranks[n] = flatten(n.Fanin(0), n.op, n.GetFaninSignByIndex(0), sign) +
@@ -230,6 +1163,22 @@ func (g *Graph) MaximizeParallelism() {
 				return
 			}
 
+			// Leave a sum as it is if reassociating it may be too inaccurate
+			if guard != nil && root.op == NodeOp_Add {
+				numOperations := float64(operandNodes.Len() - 1)
+
+				for set := range sums {
+					// An exactly cancelling sum gets an infinite error, while sets with
+					// undefined values give NaN and are ignored
+					relError := numOperations * unitRoundoff * absSums[set] / math.Abs(sums[set])
+
+					if relError > guard.maxRelError {
+						guard.numRefused++
+						return
+					}
+				}
+			}
+
 			// Disconnect the root from its fanins
 			for root.NumFanins() > 0 {
 				root.Fanin(0).RemoveFanout(root)
@@ -279,16 +1228,119 @@ func (g *Graph) MaximizeParallelism() {
 					operandSigns[nodeR]--
 				}
 
-				// Calculate operation node's rank
+				// Calculate operation node's rank and ready time
 				ranks[nodeT] = ranks[nodeL] + ranks[nodeR]
+				readyTimes[nodeT] = readyTimes[nodeL]
+				if readyTimes[nodeR] > readyTimes[nodeT] {
+					readyTimes[nodeT] = readyTimes[nodeR]
+				}
+				readyTimes[nodeT] += nodeOpLatency[nodeT.op]
 
 				if operandNodes.Len() != 0 {
 					// The operation node now becomes an operand for succeding operations
-					operandNodes.Push(NodePQEntry{nodeT, ranks[nodeT]})
+					operandNodes.Push(NodePQEntry{nodeT, priority(nodeT)})
 				}
 			}
+
+			// Put the sign of a multiplication tree on the root
+			if negateProduct {
+				root.NegateFaninByIndex(0)
+			}
 		} // func rebuild
 	} // func balance
 
 	g.isLevelized = false
 }
+
+// -----------------------------------------------------------------------------
+
+/*
+replaceNode replaces a node by another node. The node is disconnected from its
+fanins, its fanouts are connected to the new node, and then it's deleted from
+the graph. The fanout edges are negated if negate is true.
+*/
+func (g *Graph) replaceNode(oldNode, newNode *Node, negate bool) {
+	for _, fi := range oldNode.fanins {
+		fi.RemoveFanout(oldNode)
+	}
+
+	for _, fo := range oldNode.fanouts {
+		newNode.AddFanout(fo)
+		index := fo.ReplaceFanin(oldNode, newNode)
+
+		if negate {
+			fo.NegateFaninByIndex(index)
+		}
+	}
+
+	g.DeleteNodeByName(oldNode.name)
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+maxPowerExponent is the largest integer exponent ReducePower() replaces by
+multiplications.
+*/
+const maxPowerExponent = 1024
+
+/*
+additionChain returns a shortest star addition chain for n, a sequence starting
+with 1 and ending with n where each element is the previous element plus an
+earlier element. Star chains are shortest addition chains for n < 12509.
+
+The chain is found by iterative deepening search, which is fast for exponents
+found in practice, and the binary method is used for large n.
+*/
+func additionChain(n int) []int {
+	if n <= 1 {
+		return []int{1}
+	}
+
+	if n > 256 {
+		chain := []int{1}
+		for bit := bits.Len(uint(n)) - 2; bit >= 0; bit-- {
+			chain = append(chain, 2*chain[len(chain)-1])
+			if n&(1<<uint(bit)) != 0 {
+				chain = append(chain, chain[len(chain)-1]+1)
+			}
+		}
+		return chain
+	}
+
+	chain := make([]int, 1, 2*bits.Len(uint(n)))
+	chain[0] = 1
+
+	var search func(maxLength int) bool
+	search = func(maxLength int) bool {
+		last := chain[len(chain)-1]
+		if last == n {
+			return true
+		}
+
+		// Prune if doubling until the maximum length can't reach n
+		if len(chain) == maxLength || last<<uint(maxLength-len(chain)) < n {
+			return false
+		}
+
+		for i := len(chain) - 1; i >= 0; i-- {
+			next := last + chain[i]
+			if next > n {
+				continue
+			}
+
+			chain = append(chain, next)
+			if search(maxLength) {
+				return true
+			}
+			chain = chain[:len(chain)-1]
+		}
+
+		return false
+	}
+
+	for maxLength := bits.Len(uint(n)); !search(maxLength); maxLength++ {
+	}
+
+	return chain
+}
@@ -0,0 +1,707 @@
+package forge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFoldConstantsNested(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0] * ((1 + 2) * (3 + 4))")
+
+	checkEquivalence(t, g, func(g *Graph) {
+		if n := g.FoldConstants(); n != 3 {
+			t.Errorf("got %d folded, want 3", n)
+		}
+	})
+
+	// Only the multiplication by x[0] is left and the intermediate constants
+	// are deleted
+	if n := g.NumOperationNodes(); n != 1 {
+		t.Errorf("got %d operations, want 1", n)
+	}
+	if g.NumConstantNodes() != 1 || g.constantNodes["CON21"] == nil {
+		t.Errorf("got constants %v, want only CON21", g.constantNodes)
+	}
+}
+
+func TestFoldConstantsSigns(t *testing.T) {
+	tests := []struct {
+		assignment string
+		constant   string
+		negated    bool
+	}{
+		// A negative result is stored as its absolute value on a negated edge
+		{"y[0] = x[0] * (2 - 5)", "CON3", true},
+		// A negated fanin of a folded operation
+		{"y[0] = x[0] * (2 + -3)", "CON1", true},
+		{"y[0] = x[0] * (-2 * -3)", "CON6", false},
+		// A negated edge to the folded operation cancels a negative result
+		{"y[0] = x[0] + -(2 - 5)", "CON3", false},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignment)
+
+		checkEquivalence(t, g, func(g *Graph) { g.FoldConstants() })
+
+		constant := g.constantNodes[test.constant]
+		if g.NumConstantNodes() != 1 || constant == nil {
+			t.Errorf("%s: got constants %v, want only %s", test.assignment, g.constantNodes, test.constant)
+			continue
+		}
+		if fo := constant.Fanout(0); fo.GetFaninSignByNode(constant) != test.negated {
+			t.Errorf("%s: got negated %v, want %v", test.assignment, !test.negated, test.negated)
+		}
+	}
+}
+
+func TestFoldConstantsNonFinite(t *testing.T) {
+	g := buildTestGraph(t,
+		"y[0] = x[0] + 1/(2 - 2)",
+		"y[1] = x[0] + power(0 - 2, 0.5)")
+
+	// The subtractions are folded but the division by zero and the square root
+	// of a negative number are left to the hardware
+	if n := g.FoldConstants(); n != 2 {
+		t.Errorf("got %d folded, want 2", n)
+	}
+
+	ops := countOps(g)
+	if ops[NodeOp_Div] != 1 || ops[NodeOp_Power] != 1 || ops[NodeOp_Add] != 2 {
+		t.Errorf("got operations %v, want a division, a power and 2 additions", ops)
+	}
+	for _, name := range []string{"CON0", "CON1", "CON2", "CON0.5"} {
+		if g.constantNodes[name] == nil {
+			t.Errorf("constant %s is missing", name)
+		}
+	}
+}
+
+func TestFoldConstantsMergeSpellings(t *testing.T) {
+	tests := [][]string{
+		{"y[0] = x[0]*2.0 + x[1]*2", "y[1] = x[2]*2.00"},
+		// CON2 is created while merging the other spellings
+		{"y[0] = x[0]*2.0 + x[1]*2.00", "y[1] = x[2]*02"},
+	}
+
+	for _, assignments := range tests {
+		g := buildTestGraph(t, assignments...)
+
+		// Merging constants doesn't fold any operation
+		checkEquivalence(t, g, func(g *Graph) {
+			if n := g.FoldConstants(); n != 0 {
+				t.Errorf("%v: got %d folded, want 0", assignments, n)
+			}
+		})
+
+		constant := g.constantNodes["CON2"]
+		if g.NumConstantNodes() != 1 || constant == nil {
+			t.Fatalf("%v: got constants %v, want only CON2", assignments, g.constantNodes)
+		}
+		if n := constant.NumFanouts(); n != 3 {
+			t.Errorf("%v: got %d fanouts of CON2, want 3", assignments, n)
+		}
+	}
+}
+
+func TestSimplifyArithmetic(t *testing.T) {
+	tests := []struct {
+		assignment string
+		numOps     int
+	}{
+		{"y[0] = x[0] + 0", 0},
+		{"y[0] = 0 - x[0]", 0},
+		// x-x is 0, which in turn makes the multiplication 0
+		{"y[0] = (x[0] - x[0]) * x[1]", 0},
+		{"y[0] = x[0] * (x[1] - x[1]) + x[2]", 0},
+		// The sign of the removed operation moves to its fanout
+		{"y[0] = x[1] + x[0] * -1", 1},
+		{"y[0] = x[1] - x[0] / 1", 1},
+		{"y[0] = (0 - x[0]) / x[0] + x[1]", 1},
+		{"y[0] = power(x[0], 0) + x[1]", 1},
+		{"y[0] = power(0 - x[0], 1)", 0},
+		// Power(x,-1) is a reciprocal, not an identity
+		{"y[0] = power(x[0], -1)", 1},
+		{"y[0] = x[0] + x[0]", 1},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignment)
+
+		checkEquivalence(t, g, func(g *Graph) { g.SimplifyArithmetic() })
+
+		if n := g.NumOperationNodes(); n != test.numOps {
+			t.Errorf("%s: got %d operations, want %d", test.assignment, n, test.numOps)
+		}
+	}
+}
+
+func TestSimplifyArithmeticConstantResult(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0] / (0 - x[0])")
+
+	// 0-x is simplified to -x, then x/(-x) to -1
+	if n := g.SimplifyArithmetic(); n != 2 {
+		t.Errorf("got %d simplified, want 2", n)
+	}
+
+	// x/(-x) is -1, stored as CON1 on a negated edge to the output
+	y := getNode(t, g, "ARRy[0]")
+	if fi := y.Fanin(0); fi.name != "CON1" || !y.GetFaninSignByIndex(0) {
+		t.Errorf("got %s (negated %v), want negated CON1", fi.name, y.GetFaninSignByIndex(0))
+	}
+}
+
+func TestAdditionChain(t *testing.T) {
+	// Lengths of shortest addition chains, counted in additions
+	shortest := map[int]int{1: 0, 2: 1, 3: 2, 15: 5, 23: 6, 127: 10, 191: 11}
+
+	for n := 1; n <= 2*maxPowerExponent; n++ {
+		chain := additionChain(n)
+
+		if chain[0] != 1 || chain[len(chain)-1] != n {
+			t.Fatalf("%d: chain %v doesn't go from 1 to %d", n, chain, n)
+		}
+		for i := 1; i < len(chain); i++ {
+			isStar := false
+			for j := 0; j < i; j++ {
+				isStar = isStar || chain[i-1]+chain[j] == chain[i]
+			}
+			if !isStar {
+				t.Fatalf("%d: %d in chain %v is not a star step", n, chain[i], chain)
+			}
+		}
+
+		if length, exist := shortest[n]; exist && len(chain)-1 != length {
+			t.Errorf("%d: got chain %v, want %d additions", n, chain, length)
+		}
+	}
+}
+
+func TestReducePower(t *testing.T) {
+	tests := []struct {
+		assignment string
+		ops        map[NodeOp]int
+	}{
+		{"y[0] = power(x[0], 0) + x[1]", map[NodeOp]int{NodeOp_Add: 1}},
+		{"y[0] = power(x[0], 1)", map[NodeOp]int{}},
+		{"y[0] = power(x[0], 15)", map[NodeOp]int{NodeOp_Mul: 5}},
+		{"y[0] = power(x[0], -2)", map[NodeOp]int{NodeOp_Mul: 1, NodeOp_Div: 1}},
+		{"y[0] = power(x[0], 2.0)", map[NodeOp]int{NodeOp_Mul: 1}},
+		{"y[0] = power(x[0], 0.5)", map[NodeOp]int{NodeOp_Sqrt: 1}},
+		{"y[0] = power(x[0], -0.5)", map[NodeOp]int{NodeOp_Sqrt: 1, NodeOp_Div: 1}},
+		// Odd powers of a negated base are negated, even powers are not
+		{"y[0] = power(0 - x[0], 3) + x[1]", map[NodeOp]int{NodeOp_Mul: 2, NodeOp_Add: 1}},
+		{"y[0] = power(0 - x[0], 2) + x[1]", map[NodeOp]int{NodeOp_Mul: 1, NodeOp_Add: 1}},
+		// Intermediate powers are shared, x^2 is computed once for x^3 and x^4
+		{"y[0] = power(x[0], 3) + power(x[0], 4)", map[NodeOp]int{NodeOp_Mul: 3, NodeOp_Add: 1}},
+		// A non-constant exponent can't be reduced
+		{"y[0] = power(x[0], x[1])", map[NodeOp]int{NodeOp_Power: 1}},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignment)
+
+		checkEquivalence(t, g, func(g *Graph) {
+			g.SimplifyArithmetic()
+			g.ReducePower(false)
+		})
+
+		if ops := countOps(g); !reflect.DeepEqual(ops, test.ops) {
+			t.Errorf("%s: got operations %v, want %v", test.assignment, ops, test.ops)
+		}
+	}
+}
+
+func TestReducePowerNonInteger(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = power(x[0], 2.5)", "y[1] = power(x[0], -1.5)")
+
+	if unreduced := g.ReducePower(false); len(unreduced) != 2 {
+		t.Errorf("got unreduced %v, want both powers", unreduced)
+	}
+
+	checkEquivalence(t, g, func(g *Graph) {
+		if unreduced := g.ReducePower(true); len(unreduced) != 0 {
+			t.Errorf("got unreduced %v with exp and log", unreduced)
+		}
+	})
+
+	want := map[NodeOp]int{NodeOp_Exp: 2, NodeOp_Log: 2, NodeOp_Mul: 2}
+	if ops := countOps(g); !reflect.DeepEqual(ops, want) {
+		t.Errorf("got operations %v, want %v", ops, want)
+	}
+}
+
+func TestEliminateDuplicatedOperation(t *testing.T) {
+	tests := []struct {
+		assignments   []string
+		numEliminated int
+	}{
+		{[]string{"y[0] = x[0] + x[1]", "y[1] = x[1] + x[0]"}, 1},
+		// b-a is the negation of a-b
+		{[]string{"y[0] = x[0] - x[1]", "y[1] = x[1] - x[0]"}, 1},
+		{[]string{"y[0] = x[0] - x[1]", "y[1] = x[0] + x[1]"}, 0},
+		// Division and power are not commutative
+		{[]string{"y[0] = x[0] / x[1]", "y[1] = x[1] / x[0]"}, 0},
+		{[]string{"y[0] = power(x[0], x[1])", "y[1] = power(x[1], x[0])"}, 0},
+		// Eliminating the sums makes the products equal
+		{[]string{"y[0] = (x[0] + x[1]) * x[2]", "y[1] = x[2] * (x[1] + x[0])"}, 2},
+		{[]string{"y[0] = sin(x[0]) + sin(x[0])"}, 1},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignments...)
+		numOps := g.NumOperationNodes()
+
+		checkEquivalence(t, g, func(g *Graph) {
+			if n := g.EliminateDuplicatedOperation(); n != test.numEliminated {
+				t.Errorf("%v: got %d eliminated, want %d", test.assignments, n, test.numEliminated)
+			}
+		})
+
+		if n := g.NumOperationNodes(); n != numOps-test.numEliminated {
+			t.Errorf("%v: got %d operations, want %d", test.assignments, n, numOps-test.numEliminated)
+		}
+	}
+}
+
+func TestEliminateDuplicatedOperationNegatedFanins(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0] * x[1]", "y[1] = x[0] * x[1]", "y[2] = x[0] / x[1]", "y[3] = x[0] / x[1]")
+
+	// Legalize moves signs of products to fanouts, negate fanins afterwards to
+	// get (-a)*b, a*(-b), (-a)/b and a/(-b)
+	y := []*Node{getNode(t, g, "ARRy[0]"), getNode(t, g, "ARRy[1]"), getNode(t, g, "ARRy[2]"), getNode(t, g, "ARRy[3]")}
+	y[0].Fanin(0).NegateFaninByIndex(0)
+	y[1].Fanin(0).NegateFaninByIndex(1)
+	y[2].Fanin(0).NegateFaninByIndex(0)
+	y[3].Fanin(0).NegateFaninByIndex(1)
+
+	checkEquivalence(t, g, func(g *Graph) {
+		if n := g.EliminateDuplicatedOperation(); n != 2 {
+			t.Errorf("got %d eliminated, want 2", n)
+		}
+	})
+}
+
+func TestMaximizeParallelismProducts(t *testing.T) {
+	tests := []struct {
+		assignment string
+		depth      int
+	}{
+		{"y[0] = x[0]*x[1]*x[2]*x[3]*x[4]*x[5]*x[6]*x[7]", 4},
+		// Negated operands go to the sign of the product
+		{"y[0] = x[0]*(0-x[1])*x[2]*(0-x[3])*(0-x[4])*x[5]*x[6]*x[7]", 4},
+		// Balanced products are operands of a balanced sum
+		{"y[0] = x[0]*x[1]*x[2]*x[3] + x[4] + x[5] + x[6] + x[7]", 4},
+		{"y[0] = x[4] - x[5] - x[6] - x[0]*x[1]*x[2]*(x[3] + x[7] + x[8] + x[9])", 5},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignment)
+		g.SimplifyArithmetic()
+
+		checkEquivalence(t, g, (*Graph).MaximizeParallelism)
+
+		if depth := g.Levelize(); depth != test.depth {
+			t.Errorf("%s: got depth %d, want %d", test.assignment, depth, test.depth)
+		}
+	}
+}
+
+func TestMaximizeParallelismNegatedProductTree(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0]*x[1]*x[2]*x[3]*x[4]")
+
+	// Legalize moves signs of products to fanouts, negate internal edges of the
+	// tree afterwards so that the tree has an odd number of negations
+	var muls []*Node
+	for n := getNode(t, g, "ARRy[0]").Fanin(0); n.kind == NodeKind_Operation; n = n.Fanin(0) {
+		muls = append(muls, n)
+	}
+	muls[0].NegateFaninByIndex(0)
+	muls[1].NegateFaninByIndex(1)
+	muls[2].NegateFaninByIndex(0)
+
+	checkEquivalence(t, g, (*Graph).MaximizeParallelism)
+}
+
+func TestMaximizeParallelismByLatency(t *testing.T) {
+	// sin(sin(x)) is ready long after the other operands of the sum, so it
+	// should be added last
+	assignment := "y[0] = x[1] + x[2] + sin(sin(x[0])) + x[3] + x[4] + x[5]"
+
+	byRank := buildTestGraph(t, assignment)
+	byRank.MaximizeParallelism()
+
+	byLatency := buildTestGraph(t, assignment)
+	checkEquivalence(t, byLatency, (*Graph).MaximizeParallelismByLatency)
+
+	rankPath, latencyPath := byRank.Stats().CriticalPath, byLatency.Stats().CriticalPath
+	// Two sines and the final addition
+	if latencyPath != 7 || latencyPath >= rankPath {
+		t.Errorf("got critical path %d by latency and %d by rank, want 7 by latency", latencyPath, rankPath)
+	}
+}
+
+func TestFactorizeSums(t *testing.T) {
+	tests := []struct {
+		assignments []string
+		numSaved    int
+		numMuls     int
+	}{
+		{[]string{"y[0] = x[0]*x[1] + x[0]*x[2] + x[0]*x[3]"}, 2, 1},
+		{[]string{"y[0] = x[0]*x[1] - x[2]*x[0]"}, 1, 1},
+		{[]string{"y[0] = x[1] - x[0]*x[1] + x[2] - x[0]*x[3]"}, 1, 1},
+		{[]string{"y[0] = (0 - x[0])*x[1] + x[0]*x[2]"}, 1, 1},
+		{[]string{"y[0] = x[0]*x[0] + x[0]*x[1]"}, 1, 1},
+		{[]string{"y[0] = x[0]*x[1] + x[2]*x[3]"}, 0, 2},
+		// A product used elsewhere is not factored, it would be duplicated
+		{[]string{"y[0] = x[0]*x[1] + x[0]*x[2]", "y[1] = x[0]*x[1]"}, 0, 2},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignments...)
+		g.SimplifyArithmetic()
+		g.EliminateDuplicatedOperation()
+
+		checkEquivalence(t, g, func(g *Graph) {
+			if n := g.FactorizeSums(); n != test.numSaved {
+				t.Errorf("%v: got %d saved, want %d", test.assignments, n, test.numSaved)
+			}
+		})
+
+		if n := countOps(g)[NodeOp_Mul]; n != test.numMuls {
+			t.Errorf("%v: got %d multiplications, want %d", test.assignments, n, test.numMuls)
+		}
+	}
+}
+
+func TestFuseSinCos(t *testing.T) {
+	tests := []struct {
+		assignments []string
+		numFused    int
+		ops         map[NodeOp]int
+	}{
+		{[]string{"y[0] = sin(x[0]) * cos(x[0])"},
+			1, map[NodeOp]int{NodeOp_SinCos: 1, NodeOp_SinCosSin: 1, NodeOp_SinCosCos: 1, NodeOp_Mul: 1}},
+		// Duplicated sines select the same output
+		{[]string{"y[0] = sin(x[0]) + cos(x[0])", "y[1] = sin(x[0])"},
+			1, map[NodeOp]int{NodeOp_SinCos: 1, NodeOp_SinCosSin: 1, NodeOp_SinCosCos: 1, NodeOp_Add: 1}},
+		{[]string{"y[0] = sin(-x[0]) + cos(-x[0])"},
+			1, map[NodeOp]int{NodeOp_SinCos: 1, NodeOp_SinCosSin: 1, NodeOp_SinCosCos: 1, NodeOp_Add: 1}},
+		{[]string{"y[0] = sin(x[0]) + cos(x[1])"},
+			0, map[NodeOp]int{NodeOp_Sin: 1, NodeOp_Cos: 1, NodeOp_Add: 1}},
+		// Constant arguments are left to constant folding
+		{[]string{"y[0] = x[0] * sin(2) * cos(2)"},
+			0, map[NodeOp]int{NodeOp_Sin: 1, NodeOp_Cos: 1, NodeOp_Mul: 2}},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignments...)
+
+		checkEquivalence(t, g, func(g *Graph) {
+			if n := g.FuseSinCos(); n != test.numFused {
+				t.Errorf("%v: got %d fused, want %d", test.assignments, n, test.numFused)
+			}
+		})
+
+		if ops := countOps(g); !reflect.DeepEqual(ops, test.ops) {
+			t.Errorf("%v: got operations %v, want %v", test.assignments, ops, test.ops)
+		}
+	}
+}
+
+func TestFuseSinCosNegatedArguments(t *testing.T) {
+	tests := []struct {
+		assignments []string
+		// Arguments of these operations are negated after legalization, which
+		// propagates signs of sine and cosine arguments away
+		negated []NodeOp
+	}{
+		{[]string{"y[0] = sin(x[0]) * cos(x[0])"}, []NodeOp{NodeOp_Cos}},
+		{[]string{"y[0] = sin(x[0]) + cos(x[0])", "y[1] = sin(x[0])"}, []NodeOp{NodeOp_Sin}},
+		{[]string{"y[0] = sin(x[0]) / cos(x[0])"}, []NodeOp{NodeOp_Sin, NodeOp_Cos}},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignments...)
+		for _, node := range g.operationNodes {
+			for _, op := range test.negated {
+				if node.op == op {
+					node.NegateFaninByIndex(0)
+				}
+			}
+		}
+
+		// Sines and cosines of x and -x share one sincos
+		checkEquivalence(t, g, func(g *Graph) {
+			if n := g.FuseSinCos(); n != 1 {
+				t.Errorf("%v: got %d fused, want 1", test.assignments, n)
+			}
+		})
+
+		ops := countOps(g)
+		if ops[NodeOp_SinCos] != 1 || ops[NodeOp_Sin]+ops[NodeOp_Cos] != 0 {
+			t.Errorf("%v: got operations %v", test.assignments, ops)
+		}
+	}
+}
+
+func TestFuseSinCosPartlyUsed(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = sin(x[0])*0 + cos(x[0])")
+
+	// Simplification after fusing leaves the sine output without fanouts, the
+	// cosine output still selects the second value of the sincos
+	checkEquivalence(t, g, func(g *Graph) {
+		g.FuseSinCos()
+		g.SimplifyArithmetic()
+		g.FoldConstants()
+	})
+
+	want := map[NodeOp]int{NodeOp_SinCos: 1, NodeOp_SinCosSin: 1, NodeOp_SinCosCos: 1}
+	if ops := countOps(g); !reflect.DeepEqual(ops, want) {
+		t.Errorf("got operations %v, want %v", ops, want)
+	}
+	for _, node := range g.operationNodes {
+		if node.op == NodeOp_SinCosSin && node.NumFanouts() != 0 {
+			t.Errorf("got %d fanouts of the sine output, want 0", node.NumFanouts())
+		}
+	}
+}
+
+func TestShareReciprocals(t *testing.T) {
+	tests := []struct {
+		assignments  []string
+		fastMath     bool
+		numRewritten int
+		ops          map[NodeOp]int
+	}{
+		// Shared reciprocals round differently and need fast math
+		{[]string{"y[0] = x[0]/x[2] + x[1]/x[2]"},
+			false, 0, map[NodeOp]int{NodeOp_Div: 2, NodeOp_Add: 1}},
+		{[]string{"y[0] = x[0]/x[2] + x[1]/x[2]"},
+			true, 2, map[NodeOp]int{NodeOp_Div: 1, NodeOp_Mul: 2, NodeOp_Add: 1}},
+		// An existing reciprocal is shared
+		{[]string{"y[0] = 1/x[2]", "y[1] = x[0]/x[2]"},
+			true, 1, map[NodeOp]int{NodeOp_Div: 1, NodeOp_Mul: 1}},
+		{[]string{"y[0] = x[0]/x[2] - 1/x[2]", "y[1] = x[1]/x[2]"},
+			true, 2, map[NodeOp]int{NodeOp_Div: 1, NodeOp_Mul: 2, NodeOp_Add: 1}},
+		{[]string{"y[0] = x[0]/x[1] + x[1]/x[0]"},
+			false, 0, map[NodeOp]int{NodeOp_Div: 2, NodeOp_Add: 1}},
+		// Inverses of powers of two are exact
+		{[]string{"y[0] = x[0]/4", "y[1] = x[0]/0.5"},
+			false, 2, map[NodeOp]int{NodeOp_Mul: 2}},
+		{[]string{"y[0] = x[0]/3"},
+			false, 0, map[NodeOp]int{NodeOp_Div: 1}},
+		{[]string{"y[0] = x[0]/3"},
+			true, 1, map[NodeOp]int{NodeOp_Mul: 1}},
+		{[]string{"y[0] = x[0]/0"},
+			true, 0, map[NodeOp]int{NodeOp_Div: 1}},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignments...)
+
+		checkEquivalence(t, g, func(g *Graph) {
+			if n := g.ShareReciprocals(test.fastMath); n != test.numRewritten {
+				t.Errorf("%v: got %d rewritten, want %d", test.assignments, n, test.numRewritten)
+			}
+		})
+
+		if ops := countOps(g); !reflect.DeepEqual(ops, test.ops) {
+			t.Errorf("%v: got operations %v, want %v", test.assignments, ops, test.ops)
+		}
+	}
+}
+
+func TestShareReciprocalsNegatedDivisor(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0]/x[2]", "y[1] = x[1]/x[2]", "y[2] = x[1]/4",
+		"y[3] = 1/x[3]", "y[4] = x[0]/x[3]")
+
+	// Legalize moves signs of divisors to fanouts, negate a shared divisor, a
+	// constant divisor and the divisor of an existing reciprocal afterwards to
+	// get x[1]/(-x[2]), x[1]/(-4) and 1/(-x[3])
+	getNode(t, g, "ARRy[1]").Fanin(0).NegateFaninByIndex(1)
+	getNode(t, g, "ARRy[2]").Fanin(0).NegateFaninByIndex(1)
+	getNode(t, g, "ARRy[3]").Fanin(0).NegateFaninByIndex(1)
+
+	checkEquivalence(t, g, func(g *Graph) {
+		if n := g.ShareReciprocals(true); n != 4 {
+			t.Errorf("got %d rewritten, want 4", n)
+		}
+	})
+}
+
+func TestEliminateDeadCode(t *testing.T) {
+	tests := []struct {
+		assignment    string
+		numDeleted    int
+		deletedInputs []string
+	}{
+		// Simplifying the multiplication by 0 leaves the sine chain, its inputs and
+		// the 0 dead
+		{"y[0] = sin(x[1]*x[0])*0 + x[2]", 5, []string{"ARRx[0]", "ARRx[1]"}},
+		// x[0] stays live through the addition
+		{"y[0] = x[0] + cos(x[0]*x[1])*0", 4, []string{"ARRx[1]"}},
+		{"y[0] = x[0] + x[1]", 0, []string{}},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignment)
+		g.SimplifyArithmetic()
+
+		checkEquivalence(t, g, func(g *Graph) {
+			numDeleted, deletedInputs := g.EliminateDeadCode()
+			if numDeleted != test.numDeleted || !reflect.DeepEqual(deletedInputs, test.deletedInputs) {
+				t.Errorf("%s: got %d deleted with inputs %v, want %d with inputs %v",
+					test.assignment, numDeleted, deletedInputs, test.numDeleted, test.deletedInputs)
+			}
+		})
+
+		// Live nodes keep no edge to deleted nodes
+		for _, node := range g.allNodes {
+			for _, fo := range node.fanouts {
+				if g.allNodes[fo.name] != fo {
+					t.Errorf("%s: %s has deleted fanout %s", test.assignment, node.name, fo.name)
+				}
+			}
+		}
+	}
+}
+
+func TestEliminateDeadCodePartlyUsedSinCos(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = sin(x[0])*0 + cos(x[0])")
+	g.FuseSinCos()
+	g.SimplifyArithmetic()
+
+	// The unused sine output and the 0 are deleted, the sincos stays for the
+	// cosine output
+	checkEquivalence(t, g, func(g *Graph) {
+		if numDeleted, _ := g.EliminateDeadCode(); numDeleted != 2 {
+			t.Errorf("got %d deleted, want 2", numDeleted)
+		}
+	})
+
+	want := map[NodeOp]int{NodeOp_SinCos: 1, NodeOp_SinCosCos: 1}
+	if ops := countOps(g); !reflect.DeepEqual(ops, want) {
+		t.Errorf("got operations %v, want %v", ops, want)
+	}
+}
+
+func TestMaximizeParallelismWithinError(t *testing.T) {
+	// The large products cancel, so the sum is ill-conditioned and its estimated
+	// reassociation error is around 1e-8 relative to x[1] + x[2]
+	illConditioned := "y[0] = x[0]*100000000 + x[1] + x[2] - x[0]*100000000"
+	wellConditioned := "y[0] = x[0] + x[1] + x[2] + x[3] + x[4]"
+
+	tests := []struct {
+		assignment  string
+		maxRelError float64
+		numRefused  int
+	}{
+		{illConditioned, 1e-12, 1},
+		{illConditioned, 1e-3, 0},
+		{wellConditioned, 1e-12, 0},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignment)
+		depth := g.Levelize()
+
+		if err := g.EvaluateGolden(DefaultEvalOptions()); err != nil {
+			t.Fatal(err)
+		}
+
+		numRefused, err := g.MaximizeParallelismWithinError(false, test.maxRelError, DefaultEvalOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numRefused != test.numRefused {
+			t.Errorf("%s within %g: got %d refused, want %d", test.assignment, test.maxRelError, numRefused, test.numRefused)
+		}
+
+		// A refused sum keeps its chain
+		if newDepth := g.Levelize(); (newDepth == depth) != (test.numRefused > 0) {
+			t.Errorf("%s within %g: depth changed from %d to %d", test.assignment, test.maxRelError, depth, newDepth)
+		}
+
+		// The measured error is within the limit
+		outputErrors, err := g.OutputErrors()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outputErrors["ARRy[0]"] > test.maxRelError {
+			t.Errorf("%s within %g: got error %g", test.assignment, test.maxRelError, outputErrors["ARRy[0]"])
+		}
+	}
+}
+
+func TestCanonicalizeSigns(t *testing.T) {
+	tests := []struct {
+		assignments    []string
+		negatedOutputs []string
+	}{
+		// -(a-b) = b-a
+		{[]string{"y[0] = x[0] - x[1]"}, []string{}},
+		{[]string{"y[0] = (x[0] - x[1])*x[2]"}, []string{}},
+		{[]string{"y[0] = x[2] / (x[3] + (x[0] - x[1])*x[2])"}, []string{}},
+		{[]string{"y[0] = sin(x[0] - x[1])"}, []string{}},
+		{[]string{"y[0] = power(x[0] - x[1], 3)"}, []string{}},
+		// Nothing can absorb the negation
+		{[]string{"y[0] = x[0] * x[1]"}, []string{"ARRy[0]"}},
+		{[]string{"y[0] = cos(x[0] - x[1])"}, []string{"ARRy[0]"}},
+		{[]string{"y[0] = power(x[0] - x[1], 2)"}, []string{"ARRy[0]"}},
+		// The subtraction is shared, negating it would change the other output
+		{[]string{"y[0] = (x[0] - x[1])*x[2]", "y[1] = x[0] - x[1]"}, []string{"ARRy[0]"}},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignments...)
+		g.EliminateDuplicatedOperation()
+
+		// Negate y[0] as if a previous pass moved a sign to it
+		y := getNode(t, g, "ARRy[0]")
+		y.NegateFaninByIndex(0)
+
+		checkEquivalence(t, g, func(g *Graph) { g.CanonicalizeSigns() })
+
+		if negated := g.NegatedOutputs(); !reflect.DeepEqual(negated, test.negatedOutputs) {
+			t.Errorf("%v: got negated outputs %v, want %v", test.assignments, negated, test.negatedOutputs)
+		}
+	}
+}
+
+func TestCanonicalizeSignsPropagation(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = (x[0] - x[5])*x[1] + sqrt(x[2])", "y[1] = x[3]*sin(x[4])")
+
+	// Negate fanins after legalize, which already propagates signs
+	y := []*Node{getNode(t, g, "ARRy[0]"), getNode(t, g, "ARRy[1]")}
+	add := y[0].Fanin(0)
+	for i := range add.fanins {
+		add.NegateFaninByIndex(i)
+	}
+	for _, fi := range add.fanins {
+		if fi.op == NodeOp_Sqrt {
+			fi.NegateFaninByIndex(0)
+		}
+	}
+	mul := y[1].Fanin(0)
+	for _, fi := range mul.fanins {
+		if fi.op == NodeOp_Sin {
+			fi.NegateFaninByIndex(0)
+		}
+	}
+
+	// -a+(-b) becomes -(a+b), whose sign is absorbed by the subtraction in the
+	// product, the sign of the sine goes through the product to the output, and
+	// the sign of the square root stays
+	checkEquivalence(t, g, func(g *Graph) {
+		if n := g.CanonicalizeSigns(); n != 4 {
+			t.Errorf("got %d changes, want 4", n)
+		}
+	})
+
+	stats := g.Stats()
+	if stats.NumUnabsorbedSigns != 1 || !reflect.DeepEqual(stats.NegatedOutputs, []string{"ARRy[1]"}) {
+		t.Errorf("got %d unabsorbed signs and negated outputs %v, want 1 and [ARRy[1]]",
+			stats.NumUnabsorbedSigns, stats.NegatedOutputs)
+	}
+}
@@ -70,6 +70,17 @@ func (g *Graph) OutputDotFile() {
 		//label += "P" + strconv.FormatInt(int64(node.processorAssigned), 10)
 		//label += " (T" + strconv.FormatInt(int64(node.actualStartTime), 10) + ")"
 
+		// An output of a multi-output operation is drawn as a small label
+		if node.op == NodeOp_SinCosSin || node.op == NodeOp_SinCosCos {
+			w.WriteString(fmt.Sprintf("\"%s\" ", node.name))
+			w.WriteString(fmt.Sprintf("[shape=plaintext label=\"%s\"]\n", NodeOpStringLUT[node.op][7:]))
+			continue
+		}
+
+		if node.op == NodeOp_SinCos {
+			label = NodeOpStringLUT[node.op] + "\n" + label
+		}
+
 		w.WriteString(fmt.Sprintf("\"%s\" ", node.name))
 		w.WriteString(fmt.Sprintf("[shape=rect label=\"%s\"]\n", label))
 	}
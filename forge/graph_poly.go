@@ -0,0 +1,434 @@
+package forge
+
+import (
+	"math"
+	"sort"
+)
+
+/*
+RewritePolynomials finds sums that are polynomials in a single variable, for
+example a + b*x + c*Power(x,2) + d*Power(x,3), and evaluates them in Horner or
+Estrin form instead of computing each power separately. The number of rewritten
+polynomials is returned.
+
+The variable can be any input or operation node, and coefficients can be any
+product of other nodes. Terms of the same degree are summed up into a single
+coefficient, and terms of degree 0 form the constant coefficient.
+
+Horner form x*(x*(d*x + c) + b) + a uses the fewest multiplications but is
+fully sequential, while Estrin form (a + b*x) + x^2*(c + d*x) evaluates pairs of
+coefficients in parallel at the cost of computing x^2, x^4 and so on. Both forms
+are estimated with the process element latencies, and Estrin form is used only
+if it finishes earlier.
+
+This should run before ReducePower() so that powers are still recognizable.
+*/
+func (g *Graph) RewritePolynomials() int {
+	type term struct {
+		factors []*Node
+		sign    bool
+	}
+	type monomial struct {
+		coefficient term
+		degree      int
+	}
+
+	// Estimated ready time of each node, see polyBuilder
+	readyTimes := make(map[*Node]int)
+	for _, node := range g.TopologicalOrder() {
+		for _, fi := range node.fanins {
+			if readyTimes[fi] > readyTimes[node] {
+				readyTimes[node] = readyTimes[fi]
+			}
+		}
+		readyTimes[node] += nodeOpLatency[node.op]
+	}
+
+	numRewritten := 0
+
+	for _, root := range g.TopologicalOrder() {
+		if root.kind != NodeKind_Operation || root.op != NodeOp_Add ||
+			g.allNodes[root.name] != root {
+			continue
+		}
+		// Skip internal nodes of a sum, they are processed with the root
+		if root.NumFanouts() == 1 && root.Fanout(0).op == NodeOp_Add {
+			continue
+		}
+
+		// Flatten the sum into terms and each term into factors, signs of internal
+		// additions and multiplications go to the terms
+		terms := []term{}
+
+		var flattenProduct func(n *Node, t *term)
+		flattenProduct = func(n *Node, t *term) {
+			for i, fi := range n.fanins {
+				t.sign = t.sign != n.GetFaninSignByIndex(i)
+
+				if fi.kind == NodeKind_Operation && fi.op == NodeOp_Mul && fi.NumFanouts() == 1 {
+					flattenProduct(fi, t)
+				} else {
+					t.factors = append(t.factors, fi)
+				}
+			}
+		}
+
+		var flattenSum func(n *Node, sign bool)
+		flattenSum = func(n *Node, sign bool) {
+			for i, fi := range n.fanins {
+				fiSign := sign != n.GetFaninSignByIndex(i)
+
+				if fi.kind == NodeKind_Operation && fi.NumFanouts() == 1 &&
+					(fi.op == NodeOp_Add || fi.op == NodeOp_Mul) {
+					if fi.op == NodeOp_Add {
+						flattenSum(fi, fiSign)
+					} else {
+						t := term{sign: fiSign}
+						flattenProduct(fi, &t)
+						terms = append(terms, t)
+					}
+				} else {
+					terms = append(terms, term{[]*Node{fi}, fiSign})
+				}
+			}
+		}
+		flattenSum(root, false)
+
+		// Find the variable appearing in the most terms
+		numTerms := make(map[*Node]int)
+		maxDegrees := make(map[*Node]int)
+		for _, t := range terms {
+			degrees := make(map[*Node]int)
+			for _, f := range t.factors {
+				if base, exponent, _ := polyPower(f); base != nil {
+					degrees[base] += exponent
+				}
+			}
+
+			for base, degree := range degrees {
+				numTerms[base]++
+				if degree > maxDegrees[base] {
+					maxDegrees[base] = degree
+				}
+			}
+		}
+
+		var x *Node
+		for base, num := range numTerms {
+			if num < 2 || maxDegrees[base] < 2 {
+				continue
+			}
+			// Break ties by name so that the result is deterministic
+			if x == nil || num > numTerms[x] || num == numTerms[x] && base.name < x.name {
+				x = base
+			}
+		}
+		if x == nil {
+			continue
+		}
+
+		// Split each term into a monomial of x and its coefficient, the coefficient
+		// of a degree is the sum of the coefficients of the terms of that degree
+		coefficients := make(map[int][]term)
+		for _, t := range terms {
+			m := monomial{term{sign: t.sign}, 0}
+
+			for _, f := range t.factors {
+				if base, exponent, negate := polyPower(f); base == x {
+					m.degree += exponent
+					m.coefficient.sign = m.coefficient.sign != negate
+				} else {
+					m.coefficient.factors = append(m.coefficient.factors, f)
+				}
+			}
+
+			coefficients[m.degree] = append(coefficients[m.degree], m.coefficient)
+		}
+
+		degrees := []int{}
+		for degree := range coefficients {
+			degrees = append(degrees, degree)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(degrees)))
+
+		// build evaluates the polynomial in Horner or Estrin form
+		build := func(b *polyBuilder, estrin bool) polyValue {
+			b.powers = map[int]polyValue{1: b.leaf(x, false)}
+
+			coefficientValues := make(map[int]polyValue)
+			for _, degree := range degrees {
+				var sum polyValue
+				for i, t := range coefficients[degree] {
+					product := polyValue{one: true, negate: t.sign}
+					for _, f := range t.factors {
+						product = b.mul(product, b.leaf(f, false))
+					}
+
+					if i == 0 {
+						sum = product
+					} else {
+						sum = b.add(sum, product)
+					}
+				}
+				coefficientValues[degree] = sum
+			}
+
+			if estrin {
+				value, _ := b.estrin(coefficientValues, 0, degrees[0]+1)
+				return value
+			}
+
+			return b.horner(coefficientValues, degrees)
+		}
+
+		horner := &polyBuilder{readyTimes: readyTimes}
+		estrin := &polyBuilder{readyTimes: readyTimes}
+		useEstrin := build(estrin, true).ready < build(horner, false).ready
+
+		b := &polyBuilder{g: g, readyTimes: readyTimes}
+		result := b.materialize(build(b, useEstrin))
+
+		// Replace the sum and delete the nodes it no longer needs
+		fanins := append([]*Node{}, root.fanins...)
+		g.replaceNode(root, result.node, result.negate)
+		for _, fi := range fanins {
+			g.deleteUnusedOperations(fi)
+		}
+
+		numRewritten++
+	}
+
+	g.isLevelized = false
+
+	return numRewritten
+}
+
+/*
+polyPower checks if a node is a positive integer power of a base node, either
+the base itself or Power(base, k), and returns the base, the exponent, and
+whether the power is negated because of an odd power of a negated base. A nil
+base is returned for a constant or a power with another exponent.
+*/
+func polyPower(n *Node) (*Node, int, bool) {
+	if n.kind == NodeKind_Constant {
+		return nil, 0, false
+	}
+
+	if n.kind != NodeKind_Operation || n.op != NodeOp_Power {
+		return n, 1, false
+	}
+
+	exponentNode := n.Fanin(1)
+	if exponentNode.kind != NodeKind_Constant || n.Fanin(0).kind == NodeKind_Constant {
+		return nil, 0, false
+	}
+
+	exponent := exponentNode.value
+	if n.GetFaninSignByIndex(1) {
+		exponent = -exponent
+	}
+	if exponent < 1 || exponent > maxPowerExponent || exponent != math.Trunc(exponent) {
+		return n, 1, false
+	}
+
+	return n.Fanin(0), int(exponent), n.GetFaninSignByIndex(0) && int(exponent)%2 == 1
+}
+
+/*
+deleteUnusedOperations deletes an operation node without fanout, and then its
+fanins that become unused.
+*/
+func (g *Graph) deleteUnusedOperations(n *Node) {
+	if n.kind != NodeKind_Operation || n.NumFanouts() > 0 || g.allNodes[n.name] != n {
+		return
+	}
+
+	fanins := n.fanins
+	for _, fi := range fanins {
+		fi.RemoveFanout(n)
+	}
+	g.DeleteNodeByName(n.name)
+
+	for _, fi := range fanins {
+		g.deleteUnusedOperations(fi)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+polyValue is an intermediate value of a polynomial evaluation, it's the value
+of node, or 1 if one is true, negated if negate is true.
+*/
+type polyValue struct {
+	node   *Node
+	one    bool
+	negate bool
+	ready  int
+}
+
+/*
+polyBuilder builds operations evaluating a polynomial. If g is nil, no node is
+created and only the ready time of the result is estimated, so that different
+forms can be compared before building one of them.
+*/
+type polyBuilder struct {
+	g          *Graph
+	readyTimes map[*Node]int
+
+	// Powers of the variable computed so far, indexed by the exponent
+	powers map[int]polyValue
+}
+
+/*
+leaf returns the value of an existing node.
+*/
+func (b *polyBuilder) leaf(n *Node, negate bool) polyValue {
+	return polyValue{node: n, negate: negate, ready: b.readyTimes[n]}
+}
+
+/*
+materialize returns the value with a node, creating the constant 1 if needed.
+*/
+func (b *polyBuilder) materialize(v polyValue) polyValue {
+	if v.one {
+		v.one = false
+		if b.g != nil {
+			v.node = b.g.GetConstantNode(1)
+		}
+	}
+
+	return v
+}
+
+/*
+operation returns the value of a binary operation of two values.
+*/
+func (b *polyBuilder) operation(op NodeOp, l, r polyValue) polyValue {
+	l, r = b.materialize(l), b.materialize(r)
+
+	v := polyValue{ready: l.ready}
+	if r.ready > v.ready {
+		v.ready = r.ready
+	}
+	v.ready += nodeOpLatency[op]
+
+	// Signs of an addition are on its fanin edges, while the sign of a product
+	// goes to the result
+	if op == NodeOp_Mul {
+		v.negate = l.negate != r.negate
+	}
+
+	if b.g != nil {
+		v.node = b.g.addOperationNode(op)
+		v.node.Receive(l.node)
+		v.node.Receive(r.node)
+
+		if op == NodeOp_Add {
+			if l.negate {
+				v.node.NegateFaninByIndex(0)
+			}
+			if r.negate {
+				v.node.NegateFaninByIndex(1)
+			}
+		}
+
+		b.readyTimes[v.node] = v.ready
+	}
+
+	return v
+}
+
+/*
+add returns the sum of two values.
+*/
+func (b *polyBuilder) add(l, r polyValue) polyValue {
+	return b.operation(NodeOp_Add, l, r)
+}
+
+/*
+mul returns the product of two values, a multiplication by 1 is skipped.
+*/
+func (b *polyBuilder) mul(l, r polyValue) polyValue {
+	if l.one {
+		r.negate = r.negate != l.negate
+		return r
+	}
+	if r.one {
+		l.negate = l.negate != r.negate
+		return l
+	}
+
+	return b.operation(NodeOp_Mul, l, r)
+}
+
+/*
+power returns the variable to the power of a positive integer exponent, using a
+shortest addition chain and reusing powers computed before.
+*/
+func (b *polyBuilder) power(exponent int) polyValue {
+	chain := additionChain(exponent)
+	for i := 1; i < len(chain); i++ {
+		if _, exist := b.powers[chain[i]]; exist {
+			continue
+		}
+
+		for j := 0; j < i; j++ {
+			if chain[i-1]+chain[j] == chain[i] {
+				b.powers[chain[i]] = b.mul(b.powers[chain[i-1]], b.powers[chain[j]])
+				break
+			}
+		}
+	}
+
+	return b.powers[exponent]
+}
+
+/*
+horner evaluates a polynomial in Horner form, degrees are sorted from high to
+low and missing degrees are skipped by multiplying with a higher power.
+*/
+func (b *polyBuilder) horner(coefficients map[int]polyValue, degrees []int) polyValue {
+	result := coefficients[degrees[0]]
+
+	for i := 1; i < len(degrees); i++ {
+		result = b.mul(result, b.power(degrees[i-1]-degrees[i]))
+		result = b.add(result, coefficients[degrees[i]])
+	}
+
+	if lowest := degrees[len(degrees)-1]; lowest > 0 {
+		result = b.mul(result, b.power(lowest))
+	}
+
+	return result
+}
+
+/*
+estrin evaluates the part of a polynomial from degree low to high (exclusive) in
+Estrin form, divided by x^low. The part is split at the largest power of two h
+below its size into low + x^h*high. False is returned if the part has no
+coefficient.
+*/
+func (b *polyBuilder) estrin(coefficients map[int]polyValue, low, high int) (polyValue, bool) {
+	if high-low == 1 {
+		value, exist := coefficients[low]
+		return value, exist
+	}
+
+	h := 1
+	for 2*h < high-low {
+		h *= 2
+	}
+
+	lowValue, lowExist := b.estrin(coefficients, low, low+h)
+	highValue, highExist := b.estrin(coefficients, low+h, high)
+
+	switch {
+	case !highExist:
+		return lowValue, lowExist
+	case !lowExist:
+		return b.mul(highValue, b.power(h)), true
+	}
+
+	return b.add(lowValue, b.mul(highValue, b.power(h))), true
+}
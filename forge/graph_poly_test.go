@@ -0,0 +1,44 @@
+package forge
+
+import (
+	"testing"
+)
+
+func TestRewritePolynomials(t *testing.T) {
+	tests := []struct {
+		assignment   string
+		numRewritten int
+		numMuls      int
+	}{
+		// Estrin form (1 + 2x) + x^2*(3 + 4x) finishes before Horner form
+		{"y[0] = 1 + 2*x[0] + 3*power(x[0], 2) + 4*power(x[0], 3)", 1, 4},
+		// Missing degrees, 3x^2 + (2x)*x^4
+		{"y[0] = 2*power(x[0], 5) + 3*power(x[0], 2)", 1, 5},
+		// Terms of the same degree share a coefficient, x*(x + x[1] + x[2])
+		{"y[0] = x[1]*x[0] + x[2]*x[0] + power(x[0], 2)", 1, 1},
+		// An odd power of a negated base is negated, (x[1] - x)*x^2 + x[2]
+		{"y[0] = power(0 - x[0], 3) + x[1]*power(x[0], 2) + x[2]", 1, 2},
+		// A non-integer power is a term of degree 0, x*(x + 1) + x^2.5
+		{"y[0] = power(x[0], 2.5) + power(x[0], 2) + x[0]", 1, 1},
+		// x[1] is in the most terms, so x[0]^2 is a coefficient
+		{"y[0] = x[0]*x[1] + power(x[0], 2)*power(x[1], 2) + x[1]", 1, 3},
+		// Not polynomials of degree 2 or higher
+		{"y[0] = x[0] + x[1]*x[0]", 0, 1},
+		{"y[0] = power(x[0], 2) + x[1]", 0, 0},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignment)
+		g.SimplifyArithmetic()
+
+		checkEquivalence(t, g, func(g *Graph) {
+			if n := g.RewritePolynomials(); n != test.numRewritten {
+				t.Errorf("%s: got %d rewritten, want %d", test.assignment, n, test.numRewritten)
+			}
+		})
+
+		if n := countOps(g)[NodeOp_Mul]; n != test.numMuls {
+			t.Errorf("%s: got %d multiplications, want %d", test.assignment, n, test.numMuls)
+		}
+	}
+}
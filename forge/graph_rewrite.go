@@ -0,0 +1,895 @@
+package forge
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+RewriteRule is a user-defined rewrite rule, loaded from a rule file by
+LoadRewriteRules() and applied by Graph.ApplyRewriteRules().
+
+A rule file has one rule per line, empty lines and lines starting with # are
+ignored:
+
+	name: pattern -> replacement [if guard && guard ...]
+
+Patterns and replacements are expressions of +, -, *, / and ^, the functions
+Power, Sqrt, Sin and Cos, numbers, and variables. A variable matches any node,
+and all occurrences of a variable must match the same node with the same sign.
+Signs are matched the way they are stored in the graph, so -x matches a negated
+edge and -(a*b) also matches (-a)*b. Sums and products match their operands in
+either order.
+
+A guard is a comparison (<, <=, >, >=, == or !=) of two expressions of the
+variables, or const(x) or integer(x) to require a variable to match a constant
+or an integer constant. For example:
+
+	# sin(x)^2 + cos(x)^2 is 1
+	pythagoras: Sin(x)^2 + Cos(x)^2 -> 1
+	sqrt-square: Sqrt(x^2) -> x if x >= 0
+
+Comparisons of non-constant values are evaluated on sampled input values, so
+they express assumptions about the inputs rather than facts the compiler can
+prove, for example a known range of a joint angle.
+*/
+type RewriteRule struct {
+	Name string
+
+	pattern     *rulePattern
+	replacement *rulePattern
+	guards      []ruleGuard
+}
+
+/*
+RewriteReport records how many times a rewrite rule is applied, and how many
+times a match is rejected because the replacement gives different sampled
+values.
+*/
+type RewriteReport struct {
+	Name        string
+	NumFired    int
+	NumRejected int
+}
+
+/*
+rulePattern is an expression of a rule. It's a variable if variable is not
+empty, a number if op is NodeOp_Nop, or an operation on operands otherwise. A
+negation is a NodeOp_Sub with a single operand, and a subtraction is an addition
+of a negation.
+*/
+type rulePattern struct {
+	op       NodeOp
+	operands []*rulePattern
+
+	variable string
+	value    float64
+}
+
+/*
+ruleGuard is a guard condition of a rule, a comparison of two expressions or a
+predicate on a variable.
+*/
+type ruleGuard struct {
+	comparison  string
+	left, right *rulePattern
+
+	predicate string
+	variable  string
+}
+
+/*
+ruleBinding is the node a variable matches, the variable is the negated value
+of the node if negate is true.
+*/
+type ruleBinding struct {
+	node   *Node
+	negate bool
+}
+
+// maxRewriteRounds bounds the rounds of rewriting in case rules undo each other
+const maxRewriteRounds = 16
+
+// -----------------------------------------------------------------------------
+
+/*
+LoadRewriteRules loads rewrite rules from a rule file, see RewriteRule for the
+format.
+*/
+func LoadRewriteRules(filename string) ([]*RewriteRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := []*RewriteRule{}
+	names := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRewriteRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("%s:%d: duplicated rule name %s", filename, lineNum, rule.Name)
+		}
+		names[rule.Name] = true
+
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+/*
+parseRewriteRule parses a line of a rule file.
+*/
+func parseRewriteRule(line string) (*RewriteRule, error) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return nil, fmt.Errorf("missing rule name")
+	}
+
+	rule := &RewriteRule{Name: strings.TrimSpace(line[:colon])}
+	if rule.Name == "" || strings.ContainsAny(rule.Name, " \t") {
+		return nil, fmt.Errorf("invalid rule name %q", rule.Name)
+	}
+
+	body := line[colon+1:]
+	arrow := strings.Index(body, "->")
+	if arrow < 0 {
+		return nil, fmt.Errorf("missing -> in rule %s", rule.Name)
+	}
+
+	replacement, guards := body[arrow+2:], ""
+	if i := strings.Index(replacement, " if "); i >= 0 {
+		replacement, guards = replacement[:i], replacement[i+4:]
+	}
+
+	var err error
+	if rule.pattern, err = parseRulePattern(body[:arrow]); err != nil {
+		return nil, fmt.Errorf("pattern of rule %s: %v", rule.Name, err)
+	}
+	if rule.replacement, err = parseRulePattern(replacement); err != nil {
+		return nil, fmt.Errorf("replacement of rule %s: %v", rule.Name, err)
+	}
+
+	if rule.pattern.op == NodeOp_Nop || rule.pattern.op == NodeOp_Sub {
+		return nil, fmt.Errorf("pattern of rule %s must be an operation", rule.Name)
+	}
+
+	// Variables of the replacement and guards must be bound by the pattern
+	variables := make(map[string]bool)
+	rule.pattern.variables(variables)
+
+	checkVariables := func(p *rulePattern, where string) error {
+		used := make(map[string]bool)
+		p.variables(used)
+		for v := range used {
+			if !variables[v] {
+				return fmt.Errorf("variable %s in the %s of rule %s is not in the pattern",
+					v, where, rule.Name)
+			}
+		}
+		return nil
+	}
+
+	if err := checkVariables(rule.replacement, "replacement"); err != nil {
+		return nil, err
+	}
+
+	if guards != "" {
+		for _, text := range strings.Split(guards, "&&") {
+			guard, err := parseRuleGuard(strings.TrimSpace(text))
+			if err != nil {
+				return nil, fmt.Errorf("guard of rule %s: %v", rule.Name, err)
+			}
+
+			if guard.predicate != "" {
+				err = checkVariables(&rulePattern{variable: guard.variable}, "guard")
+			} else if err = checkVariables(guard.left, "guard"); err == nil {
+				err = checkVariables(guard.right, "guard")
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			rule.guards = append(rule.guards, guard)
+		}
+	}
+
+	return rule, nil
+}
+
+/*
+parseRuleGuard parses a guard condition.
+*/
+func parseRuleGuard(text string) (ruleGuard, error) {
+	for _, predicate := range []string{"const", "integer"} {
+		if strings.HasPrefix(text, predicate+"(") && strings.HasSuffix(text, ")") {
+			variable := strings.TrimSpace(text[len(predicate)+1 : len(text)-1])
+			if !isRuleIdentifier(variable) {
+				return ruleGuard{}, fmt.Errorf("%s() needs a variable, got %q", predicate, variable)
+			}
+			return ruleGuard{predicate: predicate, variable: variable}, nil
+		}
+	}
+
+	// Two-character comparisons first so that <= isn't taken as <
+	for _, comparison := range []string{"<=", ">=", "==", "!=", "<", ">"} {
+		i := strings.Index(text, comparison)
+		if i < 0 {
+			continue
+		}
+
+		left, err := parseRulePattern(text[:i])
+		if err != nil {
+			return ruleGuard{}, err
+		}
+		right, err := parseRulePattern(text[i+len(comparison):])
+		if err != nil {
+			return ruleGuard{}, err
+		}
+
+		return ruleGuard{comparison: comparison, left: left, right: right}, nil
+	}
+
+	return ruleGuard{}, fmt.Errorf("invalid guard %q", text)
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+ruleParser is a recursive descent parser of rule expressions:
+
+	sum     = product { ("+" | "-") product }
+	product = unary { ("*" | "/") unary }
+	unary   = "-" unary | power
+	power   = primary [ "^" unary ]
+	primary = number | variable | function "(" sum { "," sum } ")" | "(" sum ")"
+*/
+type ruleParser struct {
+	tokens []string
+	pos    int
+}
+
+/*
+parseRulePattern parses an expression of a rule.
+*/
+func parseRulePattern(text string) (*rulePattern, error) {
+	tokens, err := tokenizeRule(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	p := &ruleParser{tokens: tokens}
+
+	pattern, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	return pattern, nil
+}
+
+/*
+tokenizeRule splits an expression into numbers, identifiers and symbols.
+*/
+func tokenizeRule(text string) ([]string, error) {
+	tokens := []string{}
+
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(text) && (unicode.IsDigit(rune(text[j])) || text[j] == '.') {
+				j++
+			}
+			// Exponent of a number such as 1e-3
+			if j < len(text) && (text[j] == 'e' || text[j] == 'E') {
+				k := j + 1
+				if k < len(text) && (text[k] == '+' || text[k] == '-') {
+					k++
+				}
+				if k < len(text) && unicode.IsDigit(rune(text[k])) {
+					for j = k; j < len(text) && unicode.IsDigit(rune(text[j])); j++ {
+					}
+				}
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(text) && isRuleIdentifier(text[j:j+1]) {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		case strings.ContainsRune("+-*/^(),", c):
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+
+	return tokens, nil
+}
+
+/*
+isRuleIdentifier checks if a string is a variable or function name.
+*/
+func isRuleIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i, c := range s {
+		if !(unicode.IsLetter(c) || c == '_' || i > 0 && unicode.IsDigit(c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *ruleParser) expect(token string) error {
+	if p.peek() != token {
+		if p.pos == len(p.tokens) {
+			return fmt.Errorf("missing %q", token)
+		}
+		return fmt.Errorf("expected %q, got %q", token, p.peek())
+	}
+
+	p.pos++
+	return nil
+}
+
+func (p *ruleParser) sum() (*rulePattern, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "+" || p.peek() == "-" {
+		token := p.tokens[p.pos]
+		p.pos++
+
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		if token == "-" {
+			right = &rulePattern{op: NodeOp_Sub, operands: []*rulePattern{right}}
+		}
+
+		left = &rulePattern{op: NodeOp_Add, operands: []*rulePattern{left, right}}
+	}
+
+	return left, nil
+}
+
+func (p *ruleParser) product() (*rulePattern, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "*" || p.peek() == "/" {
+		op := NodeOpLUT[p.tokens[p.pos]]
+		p.pos++
+
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &rulePattern{op: op, operands: []*rulePattern{left, right}}
+	}
+
+	return left, nil
+}
+
+func (p *ruleParser) unary() (*rulePattern, error) {
+	if p.peek() == "-" {
+		p.pos++
+
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &rulePattern{op: NodeOp_Sub, operands: []*rulePattern{operand}}, nil
+	}
+
+	return p.power()
+}
+
+func (p *ruleParser) power() (*rulePattern, error) {
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek() == "^" {
+		p.pos++
+
+		exponent, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &rulePattern{op: NodeOp_Power, operands: []*rulePattern{base, exponent}}, nil
+	}
+
+	return base, nil
+}
+
+func (p *ruleParser) primary() (*rulePattern, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	if token == "(" {
+		pattern, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return pattern, p.expect(")")
+	}
+
+	if value, err := strconv.ParseFloat(token, 64); err == nil {
+		return &rulePattern{op: NodeOp_Nop, value: value}, nil
+	}
+
+	if !isRuleIdentifier(token) {
+		return nil, fmt.Errorf("unexpected %q", token)
+	}
+
+	if p.peek() != "(" {
+		return &rulePattern{variable: token}, nil
+	}
+	p.pos++
+
+	// Functions are case-insensitive like in the parser
+	op, exist := ruleFunctionLUT[strings.ToLower(token)]
+	if !exist {
+		return nil, fmt.Errorf("unsupported function %s", token)
+	}
+
+	pattern := &rulePattern{op: op}
+	for {
+		operand, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		pattern.operands = append(pattern.operands, operand)
+
+		if p.peek() != "," {
+			break
+		}
+		p.pos++
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if numOperands := ruleFunctionArity[op]; len(pattern.operands) != numOperands {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", token, numOperands, len(pattern.operands))
+	}
+
+	return pattern, nil
+}
+
+/*
+ruleFunctionLUT is a lookup table for converting a function name in a rule to a
+NodeOp, only functions of the parser are supported.
+*/
+var ruleFunctionLUT = map[string]NodeOp{
+	"power": NodeOp_Power,
+	"sqrt":  NodeOp_Sqrt,
+	"sin":   NodeOp_Sin,
+	"cos":   NodeOp_Cos,
+}
+
+// ruleFunctionArity is the number of arguments of each function in a rule
+var ruleFunctionArity = map[NodeOp]int{
+	NodeOp_Power: 2,
+	NodeOp_Sqrt:  1,
+	NodeOp_Sin:   1,
+	NodeOp_Cos:   1,
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+variables collects the variables of a pattern.
+*/
+func (p *rulePattern) variables(variables map[string]bool) {
+	if p.variable != "" {
+		variables[p.variable] = true
+	}
+
+	for _, operand := range p.operands {
+		operand.variables(variables)
+	}
+}
+
+/*
+match checks if a pattern matches a node, negated if negate is true, and returns
+the bindings extended with the variables of the pattern. The given bindings are
+not modified, so that other alternatives can be tried after a failed match.
+*/
+func (p *rulePattern) match(n *Node, negate bool, bindings map[string]ruleBinding) (map[string]ruleBinding, bool) {
+	switch {
+	case p.variable != "":
+		if b, exist := bindings[p.variable]; exist {
+			return bindings, b.node == n && b.negate == negate
+		}
+
+		extended := make(map[string]ruleBinding, len(bindings)+1)
+		for v, b := range bindings {
+			extended[v] = b
+		}
+		extended[p.variable] = ruleBinding{n, negate}
+
+		return extended, true
+	case p.op == NodeOp_Nop:
+		value := n.value
+		if negate {
+			value = -value
+		}
+		return bindings, n.kind == NodeKind_Constant && value == p.value
+	case p.op == NodeOp_Sub:
+		return p.operands[0].match(n, !negate, bindings)
+	}
+
+	if n.kind != NodeKind_Operation || n.op != p.op {
+		return bindings, false
+	}
+
+	// matchOperands matches the operands of the pattern in the given order of
+	// fanins, with the sign of the node applied to the given operand
+	matchOperands := func(order []int, signed int) (map[string]ruleBinding, bool) {
+		b := bindings
+		for i, operand := range p.operands {
+			index := order[i]
+			sign := n.GetFaninSignByIndex(index) != (negate && i == signed)
+
+			var ok bool
+			if b, ok = operand.match(n.Fanin(index), sign, b); !ok {
+				return bindings, false
+			}
+		}
+		return b, true
+	}
+
+	// Orders of fanins and operands a negation can go to, a negated sum negates
+	// both operands, and a negated product or quotient negates either operand
+	orders := [][]int{{0, 1}}
+	if p.op == NodeOp_Add || p.op == NodeOp_Mul {
+		orders = append(orders, []int{1, 0})
+	}
+
+	switch p.op {
+	case NodeOp_Add:
+		for _, order := range orders {
+			b := bindings
+			ok := true
+			for i, operand := range p.operands {
+				sign := n.GetFaninSignByIndex(order[i]) != negate
+				if b, ok = operand.match(n.Fanin(order[i]), sign, b); !ok {
+					break
+				}
+			}
+			if ok {
+				return b, true
+			}
+		}
+	case NodeOp_Mul, NodeOp_Div:
+		for _, order := range orders {
+			for signed := 0; signed < 2; signed++ {
+				if b, ok := matchOperands(order, signed); ok {
+					return b, true
+				}
+				if !negate {
+					break
+				}
+			}
+		}
+	case NodeOp_Sin:
+		// Sine is odd, the negation goes to the operand
+		return matchOperands([]int{0}, 0)
+	default:
+		if !negate {
+			return matchOperands([]int{0, 1}[:len(p.operands)], -1)
+		}
+	}
+
+	return bindings, false
+}
+
+/*
+eval evaluates an expression with the values of variables in a set of sampled
+values.
+*/
+func (p *rulePattern) eval(bindings map[string]ruleBinding, values map[*Node][]float64, set int) float64 {
+	if p.variable != "" {
+		b := bindings[p.variable]
+		if b.negate {
+			return -values[b.node][set]
+		}
+		return values[b.node][set]
+	}
+
+	operands := make([]float64, len(p.operands))
+	for i, operand := range p.operands {
+		operands[i] = operand.eval(bindings, values, set)
+	}
+
+	switch p.op {
+	case NodeOp_Sub:
+		return -operands[0]
+	case NodeOp_Add:
+		return operands[0] + operands[1]
+	case NodeOp_Mul:
+		return operands[0] * operands[1]
+	case NodeOp_Div:
+		return operands[0] / operands[1]
+	case NodeOp_Power:
+		return math.Pow(operands[0], operands[1])
+	case NodeOp_Sqrt:
+		return math.Sqrt(operands[0])
+	case NodeOp_Sin:
+		return math.Sin(operands[0])
+	case NodeOp_Cos:
+		return math.Cos(operands[0])
+	}
+
+	return p.value
+}
+
+/*
+holds checks if a guard holds for the bindings in a set of sampled values.
+*/
+func (guard ruleGuard) holds(bindings map[string]ruleBinding, values map[*Node][]float64, set int) bool {
+	switch guard.predicate {
+	case "const":
+		return bindings[guard.variable].node.kind == NodeKind_Constant
+	case "integer":
+		b := bindings[guard.variable]
+		return b.node.kind == NodeKind_Constant && b.node.value == math.Trunc(b.node.value)
+	}
+
+	l := guard.left.eval(bindings, values, set)
+	r := guard.right.eval(bindings, values, set)
+
+	switch guard.comparison {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	case ">=":
+		return l >= r
+	case "==":
+		return l == r
+	}
+
+	return l != r
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+ApplyRewriteRules rewrites the graph with user-defined rules, and returns a
+report of each rule.
+
+Operation nodes are visited in topological order, and the first rule whose
+pattern matches a node and whose guards hold replaces the node. Nodes created by
+a replacement are visited in the next round, until no rule applies or after
+maxRewriteRounds rounds.
+
+Every rewrite is checked by sampling: the graph is evaluated with random inputs
+drawn from samples, and a match is rejected if its replacement doesn't give the
+same value as the matched node within the tolerances of samples for every set.
+Guards are also evaluated on the sampled values and must hold for every set.
+*/
+func (g *Graph) ApplyRewriteRules(rules []*RewriteRule, samples EvalOptions) ([]RewriteReport, error) {
+	reports := make([]RewriteReport, len(rules))
+	for i, rule := range rules {
+		reports[i].Name = rule.Name
+	}
+
+	if len(rules) == 0 {
+		return reports, nil
+	}
+
+	g.Levelize()
+
+	values, err := g.sampleValues(samples)
+	if err != nil {
+		return nil, err
+	}
+
+	for round := 0; round < maxRewriteRounds; round++ {
+		numFired := 0
+
+		for _, node := range g.TopologicalOrder() {
+			if node.kind != NodeKind_Operation || g.allNodes[node.name] != node {
+				continue
+			}
+
+			for i, rule := range rules {
+				bindings, ok := rule.pattern.match(node, false, map[string]ruleBinding{})
+				if !ok || !rule.holds(bindings, values, samples.NumSets) {
+					continue
+				}
+
+				// Check the replacement against the matched node with sampled values
+				equivalent := true
+				for set := 0; set < samples.NumSets && equivalent; set++ {
+					equivalent = samples.matches(rule.replacement.eval(bindings, values, set), values[node][set])
+				}
+				if !equivalent {
+					reports[i].NumRejected++
+					continue
+				}
+
+				// A replacement building the same expression would fire again in
+				// every round
+				newNode, negate := g.buildRuleReplacement(rule.replacement, bindings, values, samples.NumSets)
+				if !negate && sameExpression(newNode, node) {
+					g.deleteUnusedOperations(newNode)
+					continue
+				}
+
+				fanins := append([]*Node{}, node.fanins...)
+				g.replaceNode(node, newNode, negate)
+				for _, fi := range fanins {
+					g.deleteUnusedOperations(fi)
+				}
+
+				reports[i].NumFired++
+				numFired++
+				break
+			}
+		}
+
+		if numFired == 0 {
+			break
+		}
+
+		g.Levelize()
+	}
+
+	g.isLevelized = false
+
+	return reports, nil
+}
+
+/*
+holds checks if all guards of a rule hold for the bindings in every set of
+sampled values.
+*/
+func (rule *RewriteRule) holds(bindings map[string]ruleBinding, values map[*Node][]float64, numSets int) bool {
+	for _, guard := range rule.guards {
+		for set := 0; set < numSets; set++ {
+			if !guard.holds(bindings, values, set) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/*
+buildRuleReplacement creates the nodes of a replacement expression, and returns
+the node of its value, which is negated if the returned bool is true. Sampled
+values of created nodes are recorded, so that they can be matched by later
+rewrites.
+*/
+func (g *Graph) buildRuleReplacement(p *rulePattern, bindings map[string]ruleBinding,
+	values map[*Node][]float64, numSets int) (*Node, bool) {
+	switch {
+	case p.variable != "":
+		b := bindings[p.variable]
+		return b.node, b.negate
+	case p.op == NodeOp_Nop:
+		node := g.GetConstantNode(math.Abs(p.value))
+		if _, exist := values[node]; !exist {
+			values[node] = make([]float64, numSets)
+			for set := range values[node] {
+				values[node][set] = node.value
+			}
+		}
+		return node, p.value < 0
+	case p.op == NodeOp_Sub:
+		node, negate := g.buildRuleReplacement(p.operands[0], bindings, values, numSets)
+		return node, !negate
+	}
+
+	node := g.addOperationNode(p.op)
+	for i, operand := range p.operands {
+		fi, negate := g.buildRuleReplacement(operand, bindings, values, numSets)
+		node.Receive(fi)
+		if negate {
+			node.NegateFaninByIndex(i)
+		}
+	}
+
+	values[node] = make([]float64, numSets)
+	for set := range values[node] {
+		values[node][set] = p.eval(bindings, values, set)
+	}
+
+	return node, false
+}
+
+/*
+sameExpression checks if two nodes compute the same expression of the same
+nodes, with operands of sums and products in any order.
+*/
+func sameExpression(a, b *Node) bool {
+	if a == b {
+		return true
+	}
+	if a.kind != NodeKind_Operation || b.kind != NodeKind_Operation ||
+		a.op != b.op || a.NumFanins() != b.NumFanins() {
+		return false
+	}
+
+	sameOperands := func(order []int) bool {
+		for i, j := range order {
+			if a.GetFaninSignByIndex(i) != b.GetFaninSignByIndex(j) ||
+				!sameExpression(a.Fanin(i), b.Fanin(j)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if a.NumFanins() == 1 {
+		return sameOperands([]int{0})
+	}
+
+	return sameOperands([]int{0, 1}) ||
+		(a.op == NodeOp_Add || a.op == NodeOp_Mul) && sameOperands([]int{1, 0})
+}
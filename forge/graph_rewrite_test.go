@@ -0,0 +1,159 @@
+package forge
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRewriteRule(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"pythagoras: Sin(x)^2 + Cos(x)^2 -> 1", ""},
+		{"halve: x/2 -> 0.5*x", ""},
+		{"sqrt-square: Sqrt(x^2) -> x if x >= 0", ""},
+		{"square: Power(x, n) -> x*x if const(n) && n == 2", ""},
+		{"Sin(x) -> 1", "missing rule name"},
+		{"bad name: Sin(x) -> 1", "invalid rule name"},
+		{"no-arrow: Sin(x)", "missing ->"},
+		{"leaf: x -> x*1", "must be an operation"},
+		{"negation: -x -> 0-x", "must be an operation"},
+		{"unbound: Sin(x) -> Cos(y)", "variable y in the replacement"},
+		{"unbound-guard: Sin(x) -> x if y > 0", "variable y in the guard"},
+		{"bad-guard: Sin(x) -> x if x", "invalid guard"},
+		{"bad-predicate: Sin(x) -> x if const(2)", "needs a variable"},
+		{"unknown: Tan(x) -> x", "unsupported function Tan"},
+		{"arity: Sin(x, y) -> x", "Sin takes 1 arguments, got 2"},
+		{"unbalanced: Sin(x -> x", `missing ")"`},
+	}
+
+	for _, test := range tests {
+		rule, err := parseRewriteRule(test.line)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.line, err, test.err)
+			}
+		} else if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+		} else if name := test.line[:strings.Index(test.line, ":")]; rule.Name != name {
+			t.Errorf("%q: got name %q", test.line, rule.Name)
+		}
+	}
+}
+
+func TestLoadRewriteRules(t *testing.T) {
+	rules, err := LoadRewriteRules("../testdata/rules.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, rule := range rules {
+		names = append(names, rule.Name)
+	}
+	if want := []string{"pythagoras", "pythagoras-product", "cos-square", "sqrt-square"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got rules %v, want %v", names, want)
+	}
+
+	// Errors name the line
+	filename := filepath.Join(t.TempDir(), "rules.txt")
+	content := "# comment\n\nsame: Sin(x) -> Sin(x)\nsame: Cos(x) -> Cos(x)\n"
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRewriteRules(filename); err == nil || !strings.Contains(err.Error(), "rules.txt:4: duplicated rule name same") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestApplyRewriteRules(t *testing.T) {
+	tests := []struct {
+		rule        string
+		assignment  string
+		numFired    int
+		numRejected int
+		ops         map[NodeOp]int
+	}{
+		{"pythagoras: Sin(x)^2 + Cos(x)^2 -> 1",
+			"y[0] = power(sin(x[0]), 2) + power(cos(x[0]), 2) + x[1]", 1, 0, map[NodeOp]int{NodeOp_Add: 1}},
+		// Sums match in either order and products match signs on either operand
+		{"pythagoras: Sin(x)^2 + Cos(x)^2 -> 1",
+			"y[0] = power(cos(x[0]), 2) + power(sin(x[0]), 2)", 1, 0, map[NodeOp]int{}},
+		{"cancel: -(x*y) + x*y -> 0",
+			"y[0] = x[1]*x[0] - x[0]*x[1]", 1, 0, map[NodeOp]int{}},
+		// All occurrences of a variable must match the same node
+		{"pythagoras: Sin(x)^2 + Cos(x)^2 -> 1",
+			"y[0] = power(sin(x[0]), 2) + power(cos(x[1]), 2)", 0, 0,
+			map[NodeOp]int{NodeOp_Sin: 1, NodeOp_Cos: 1, NodeOp_Power: 2, NodeOp_Add: 1}},
+		// The guard holds only for non-negative inputs, x[0]-1 is negative
+		{"sqrt-square: Sqrt(x^2) -> x if x >= 0",
+			"y[0] = sqrt(power(x[0], 2))", 1, 0, map[NodeOp]int{}},
+		{"sqrt-square: Sqrt(x^2) -> x if x >= 0",
+			"y[0] = sqrt(power(x[0] - 1, 2))", 0, 0, map[NodeOp]int{NodeOp_Sqrt: 1, NodeOp_Power: 1, NodeOp_Add: 1}},
+		{"square: Power(x, n) -> x*x if const(n) && n == 2",
+			"y[0] = power(x[0], 2) + power(x[0], x[1])", 1, 0, map[NodeOp]int{NodeOp_Mul: 1, NodeOp_Power: 1, NodeOp_Add: 1}},
+		// A wrong rule is rejected by sampling and changes nothing
+		{"wrong: Sin(x)*Sin(x) -> Sin(x)",
+			"y[0] = sin(x[0])*sin(x[0])", 0, 1, map[NodeOp]int{NodeOp_Sin: 1, NodeOp_Mul: 1}},
+	}
+
+	for _, test := range tests {
+		rule, err := parseRewriteRule(test.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		g := buildTestGraph(t, test.assignment)
+		g.EliminateDuplicatedOperation()
+
+		checkEquivalence(t, g, func(g *Graph) {
+			reports, err := g.ApplyRewriteRules([]*RewriteRule{rule}, DefaultEvalOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := RewriteReport{rule.Name, test.numFired, test.numRejected}
+			if reports[0] != want {
+				t.Errorf("%s on %s: got report %+v, want %+v", test.rule, test.assignment, reports[0], want)
+			}
+		})
+
+		if ops := countOps(g); !reflect.DeepEqual(ops, test.ops) {
+			t.Errorf("%s on %s: got operations %v, want %v", test.rule, test.assignment, ops, test.ops)
+		}
+	}
+}
+
+func TestRewritePassReport(t *testing.T) {
+	rules := []*RewriteRule{}
+	for _, line := range []string{"pythagoras: Sin(x)^2 + Cos(x)^2 -> 1", "wrong: x*y -> x+y"} {
+		rule, err := parseRewriteRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+
+	g := buildTestGraph(t, "y[0] = power(sin(x[0]),2) + power(cos(x[0]),2)", "y[1] = x[0]*x[1]")
+
+	pm := CreatePassManager(PassOptions{Samples: DefaultEvalOptions(), RewriteRules: rules})
+	if err := pm.SetPipeline("rewrite"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.Run(g); err != nil {
+		t.Fatal(err)
+	}
+
+	// Applications and rejections of every rule are in the report of the pass,
+	// the wrong rule is rejected again in the round after pythagoras fires
+	report := pm.Reports()[0]
+	want := []RewriteReport{{Name: "pythagoras", NumFired: 1}, {Name: "wrong", NumRejected: 2}}
+	if report.NumChanges != 1 || !reflect.DeepEqual(report.Rules, want) {
+		t.Errorf("got %d changes and rules %+v, want 1 and %+v", report.NumChanges, report.Rules, want)
+	}
+}
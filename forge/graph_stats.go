@@ -0,0 +1,251 @@
+package forge
+
+import "sort"
+
+/*
+GraphStats holds structural statistics of a graph, see Graph.Stats().
+*/
+type GraphStats struct {
+	NumNodes int `json:"numNodes"`
+
+	// Number of nodes of each kind, keyed by NodeKindStringLUT
+	NumNodesByKind map[string]int `json:"numNodesByKind"`
+	// Number of operation nodes of each operation, keyed by NodeOpStringLUT
+	NumOperationsByOp map[string]int `json:"numOperationsByOp"`
+
+	// Maximum level of the graph
+	Depth int `json:"depth"`
+	// Length of the longest path in cycles, using the process element latencies
+	CriticalPath int `json:"criticalPath"`
+
+	// Number of operation nodes having a given number of fanouts, fanouts to
+	// output nodes are not counted
+	FanoutDistribution map[int]int `json:"fanoutDistribution"`
+	// Number of operation nodes having a given level difference between their
+	// lowest and highest fanouts
+	FanoutLevelDiffDistribution map[int]int `json:"fanoutLevelDiffDistribution"`
+
+	// Number of operation nodes in the cone of more than one output
+	NumSharedOperations int `json:"numSharedOperations"`
+
+	// Number of negated edges that no adder absorbs, which need an explicit
+	// negation, edges to outputs are not counted
+	NumUnabsorbedSigns int `json:"numUnabsorbedSigns"`
+	// Outputs negated by the host when reading them back, see NegatedOutputs()
+	NegatedOutputs []string `json:"negatedOutputs"`
+
+	Outputs []OutputStats `json:"outputs"`
+}
+
+/*
+OutputStats holds statistics of the transitive fanin cone of an output node.
+*/
+type OutputStats struct {
+	Name string `json:"name"`
+
+	// Number of operation nodes in the cone
+	ConeSize int `json:"coneSize"`
+	// Number of input nodes in the cone
+	NumInputs int `json:"numInputs"`
+	// Number of operation nodes in the cone that are also in other outputs' cone
+	NumSharedOperations int `json:"numSharedOperations"`
+	// Level of the output node
+	Depth int `json:"depth"`
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+Stats collects and returns structural statistics of the graph.
+*/
+func (g *Graph) Stats() GraphStats {
+	stats := GraphStats{}
+
+	stats.NumNodes = g.NumAllNodes()
+	stats.NumNodesByKind = make(map[string]int)
+	stats.NumOperationsByOp = make(map[string]int)
+	stats.FanoutDistribution = make(map[int]int)
+	stats.FanoutLevelDiffDistribution = make(map[int]int)
+
+	stats.Depth = g.Levelize()
+
+	// Node count statistics
+	for _, node := range g.allNodes {
+		stats.NumNodesByKind[NodeKindStringLUT[node.kind]]++
+
+		if node.kind == NodeKind_Operation {
+			stats.NumOperationsByOp[NodeOpStringLUT[node.op]]++
+		}
+	}
+
+	// Critical path, calculated as the as-soon-as-possible finish time of each
+	// node in topological order
+	finishTimes := make(map[*Node]int)
+	for _, node := range g.TopologicalOrder() {
+		startTime := 0
+		for _, fi := range node.fanins {
+			if finishTimes[fi] > startTime {
+				startTime = finishTimes[fi]
+			}
+		}
+
+		finishTimes[node] = startTime
+		if node.kind == NodeKind_Operation {
+			finishTimes[node] += nodeOpLatency[node.op]
+		}
+
+		if finishTimes[node] > stats.CriticalPath {
+			stats.CriticalPath = finishTimes[node]
+		}
+	}
+
+	// Fanout number and fanout level difference statistics
+	for _, node := range g.operationNodes {
+		if node.NumFanouts() == 0 {
+			continue
+		}
+
+		numFanouts := 0
+		minFoLevel := MaxInt
+		maxFoLevel := MinInt
+
+		for _, fo := range node.fanouts {
+			if fo.kind != NodeKind_Output {
+				numFanouts++
+			}
+
+			if fo.level < minFoLevel {
+				minFoLevel = fo.level
+			}
+			if fo.level > maxFoLevel {
+				maxFoLevel = fo.level
+			}
+		}
+
+		stats.FanoutDistribution[numFanouts]++
+		stats.FanoutLevelDiffDistribution[maxFoLevel-minFoLevel]++
+	}
+
+	// Sign statistics, an adder absorbs a single negated fanin by subtracting
+	for _, node := range g.operationNodes {
+		numSigns := 0
+		for i := range node.fanins {
+			if node.GetFaninSignByIndex(i) {
+				numSigns++
+			}
+		}
+
+		if node.op == NodeOp_Add && numSigns == 1 {
+			continue
+		}
+		stats.NumUnabsorbedSigns += numSigns
+	}
+	stats.NegatedOutputs = g.NegatedOutputs()
+
+	// Cone statistics, cones are walked one output at a time so they are never
+	// held together. The first walk counts how many output cones each operation
+	// node is in, the second one collects the statistics of each output. Both
+	// walks share the visited map with a different mark for each cone.
+	outputs := g.sortedOutputNodes()
+	numCones := make(map[*Node]int)
+
+	visited := make(map[*Node]int)
+	for i, output := range outputs {
+		g.visitTransitiveFanins(output, i+1, visited, func(node *Node) {
+			if node.kind == NodeKind_Operation {
+				numCones[node]++
+			}
+		})
+	}
+
+	for _, count := range numCones {
+		if count > 1 {
+			stats.NumSharedOperations++
+		}
+	}
+
+	for i, output := range outputs {
+		outputStats := OutputStats{Name: output.name, Depth: output.level}
+
+		g.visitTransitiveFanins(output, len(outputs)+i+1, visited, func(node *Node) {
+			switch node.kind {
+			case NodeKind_Operation:
+				outputStats.ConeSize++
+				if numCones[node] > 1 {
+					outputStats.NumSharedOperations++
+				}
+			case NodeKind_Input:
+				outputStats.NumInputs++
+			}
+		})
+
+		stats.Outputs = append(stats.Outputs, outputStats)
+	}
+
+	return stats
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+sortedOutputNodes returns output nodes sorted by their name.
+*/
+func (g *Graph) sortedOutputNodes() []*Node {
+	outputs := make([]*Node, 0, len(g.outputNodes))
+	for _, node := range g.outputNodes {
+		outputs = append(outputs, node)
+	}
+
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].name < outputs[j].name })
+
+	return outputs
+}
+
+/*
+transitiveFanins returns all nodes in the transitive fanin cone of the node,
+excluding the node itself.
+*/
+func (g *Graph) transitiveFanins(n *Node) []*Node {
+	cone := []*Node{}
+	visited := map[*Node]bool{n: true}
+
+	stack := []*Node{n}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for _, fi := range node.fanins {
+			if !visited[fi] {
+				visited[fi] = true
+				cone = append(cone, fi)
+				stack = append(stack, fi)
+			}
+		}
+	}
+
+	return cone
+}
+
+/*
+visitTransitiveFanins calls visit on every node in the transitive fanin cone of
+the node, excluding the node itself.
+
+A node is visited if its entry in visited isn't mark, and the entry is set to
+mark, so walks of several cones can reuse the map by using a different mark for
+each cone.
+*/
+func (g *Graph) visitTransitiveFanins(n *Node, mark int, visited map[*Node]int, visit func(*Node)) {
+	stack := []*Node{n}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for _, fi := range node.fanins {
+			if visited[fi] != mark {
+				visited[fi] = mark
+				visit(fi)
+				stack = append(stack, fi)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package forge
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+/*
+buildStatsGraph builds y[0] = x[0]*x[1] + x[2] and y[1] = x[0]*x[1]*2, where the
+product is shared by both outputs.
+*/
+func buildStatsGraph(t *testing.T) *Graph {
+	t.Helper()
+
+	g := CreateGraph()
+	mul := addOperation(t, g, "*", getNode(t, g, "ARRx[0]"), getNode(t, g, "ARRx[1]"))
+	add := addOperation(t, g, "+", mul, getNode(t, g, "ARRx[2]"))
+	double := addOperation(t, g, "*", mul, getNode(t, g, "CON2"))
+	getNode(t, g, "ARRy[0]").Receive(add)
+	getNode(t, g, "ARRy[1]").Receive(double)
+	if err := g.Legalize(); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestStats(t *testing.T) {
+	stats := buildStatsGraph(t).Stats()
+
+	want := GraphStats{
+		NumNodes:          9,
+		NumNodesByKind:    map[string]int{"input": 3, "constant": 1, "operation": 3, "output": 2},
+		NumOperationsByOp: map[string]int{"*": 2, "+": 1},
+		Depth:             3,
+		// The shared product finishes at 2, then the multiplication by 2
+		CriticalPath: 4,
+		// The product feeds two operations, the others feed only outputs
+		FanoutDistribution:          map[int]int{2: 1, 0: 2},
+		FanoutLevelDiffDistribution: map[int]int{0: 3},
+		NumSharedOperations:         1,
+		NegatedOutputs:              []string{},
+		Outputs: []OutputStats{
+			{Name: "ARRy[0]", ConeSize: 2, NumInputs: 3, NumSharedOperations: 1, Depth: 3},
+			{Name: "ARRy[1]", ConeSize: 2, NumInputs: 2, NumSharedOperations: 1, Depth: 3},
+		},
+	}
+
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats are\n%+v\nwant\n%+v", stats, want)
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	data, err := json.Marshal(buildStatsGraph(t).Stats())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The field names are read by scripts, so they are checked literally
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"numNodes", "numNodesByKind", "numOperationsByOp", "depth",
+		"criticalPath", "fanoutDistribution", "fanoutLevelDiffDistribution",
+		"numSharedOperations", "outputs"} {
+		if _, exist := fields[name]; !exist {
+			t.Errorf("field %s is missing in %s", name, data)
+		}
+	}
+
+	outputs := fields["outputs"].([]interface{})
+	output := outputs[1].(map[string]interface{})
+	if output["name"] != "ARRy[1]" || output["coneSize"] != 2.0 || output["numInputs"] != 2.0 ||
+		output["numSharedOperations"] != 1.0 || output["depth"] != 3.0 {
+		t.Errorf("second output is %v", output)
+	}
+
+	// Integer keys of distributions become strings
+	if fields["fanoutDistribution"].(map[string]interface{})["2"] != 1.0 {
+		t.Errorf("fanout distribution is %v", fields["fanoutDistribution"])
+	}
+}
@@ -0,0 +1,539 @@
+package forge
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+/*
+addOperation adds an operation node receiving the given fanins.
+*/
+func addOperation(t testing.TB, g *Graph, op string, fanins ...*Node) *Node {
+	t.Helper()
+
+	n, err := g.AddOperationNode(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fanins {
+		n.Receive(fi)
+	}
+	return n
+}
+
+/*
+getNode gets a node by the name, see Graph.GetNodeByName().
+*/
+func getNode(t testing.TB, g *Graph, name string) *Node {
+	t.Helper()
+
+	n, err := g.GetNodeByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+/*
+buildTestGraph builds and legalizes a graph from assignments such as
+"y[0] = x[0]*x[1] + 2", the way the parser builds it from a source file. Array
+elements are named like the parser names them, so y[0] becomes the node
+ARRy[0], and the functions are power, sin and cos.
+*/
+func buildTestGraph(t testing.TB, assignments ...string) *Graph {
+	t.Helper()
+
+	g := CreateGraph()
+	for _, assignment := range assignments {
+		if err := addTestAssignment(g, assignment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Legalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+/*
+addTestAssignment adds an assignment to a graph that is not legalized yet, see
+buildTestGraph().
+*/
+func addTestAssignment(g *Graph, assignment string) error {
+	i := strings.Index(assignment, "=")
+	if i < 0 {
+		return fmt.Errorf("missing = in %q", assignment)
+	}
+
+	output, err := (&testExprParser{g: g, text: assignment[:i]}).primary()
+	if err != nil {
+		return err
+	}
+
+	p := &testExprParser{g: g, text: assignment[i+1:]}
+	value, err := p.sum()
+	if err != nil {
+		return err
+	}
+	if p.skipSpace(); p.pos < len(p.text) {
+		return fmt.Errorf("unexpected %q in %q", p.text[p.pos:], assignment)
+	}
+
+	output.Receive(value)
+
+	return nil
+}
+
+/*
+testExprParser is a recursive descent parser of C expressions, it adds the
+operation nodes of an expression while parsing it.
+*/
+type testExprParser struct {
+	g    *Graph
+	text string
+	pos  int
+}
+
+func (p *testExprParser) skipSpace() {
+	for p.pos < len(p.text) && p.text[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *testExprParser) peek() byte {
+	if p.skipSpace(); p.pos < len(p.text) {
+		return p.text[p.pos]
+	}
+	return 0
+}
+
+func (p *testExprParser) operation(op string, operands ...*Node) (*Node, error) {
+	return p.g.GetOperationNode(op, operands...)
+}
+
+func (p *testExprParser) sum() (*Node, error) {
+	left, err := p.product()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.text[p.pos : p.pos+1]
+		p.pos++
+
+		var right *Node
+		if right, err = p.product(); err == nil {
+			left, err = p.operation(op, left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *testExprParser) product() (*Node, error) {
+	left, err := p.unary()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.text[p.pos : p.pos+1]
+		p.pos++
+
+		var right *Node
+		if right, err = p.unary(); err == nil {
+			left, err = p.operation(op, left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *testExprParser) unary() (*Node, error) {
+	if p.peek() == '-' {
+		p.pos++
+
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return p.operation("-", operand)
+	}
+
+	return p.primary()
+}
+
+func (p *testExprParser) primary() (*Node, error) {
+	c := p.peek()
+
+	switch {
+	case c == '(':
+		p.pos++
+		n, err := p.sum()
+		if err == nil && p.peek() != ')' {
+			err = fmt.Errorf("missing ) in %q", p.text)
+		}
+		p.pos++
+		return n, err
+	case c == '.' || unicode.IsDigit(rune(c)):
+		start := p.pos
+		for p.pos < len(p.text) && (p.text[p.pos] == '.' || unicode.IsDigit(rune(p.text[p.pos]))) {
+			p.pos++
+		}
+		return p.g.GetNodeByName("CON" + p.text[start:p.pos])
+	case unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.text) && (unicode.IsLetter(rune(p.text[p.pos])) || unicode.IsDigit(rune(p.text[p.pos]))) {
+			p.pos++
+		}
+		name := p.text[start:p.pos]
+
+		switch p.peek() {
+		case '[':
+			end := strings.Index(p.text[p.pos:], "]")
+			if end < 0 {
+				return nil, fmt.Errorf("missing ] in %q", p.text)
+			}
+			index := p.text[p.pos+1 : p.pos+end]
+			p.pos += end + 1
+			return p.g.GetNodeByName("ARR" + name + "[" + index + "]")
+		case '(':
+			p.pos++
+			operands := []*Node{}
+			for {
+				operand, err := p.sum()
+				if err != nil {
+					return nil, err
+				}
+				operands = append(operands, operand)
+
+				if p.peek() != ',' {
+					break
+				}
+				p.pos++
+			}
+			if p.peek() != ')' {
+				return nil, fmt.Errorf("missing ) in %q", p.text)
+			}
+			p.pos++
+			return p.operation(name, operands...)
+		}
+
+		return p.g.GetNodeByName("VAR" + name)
+	}
+
+	return nil, fmt.Errorf("unexpected %q in %q", p.text[p.pos:], p.text)
+}
+
+/*
+checkEquivalence evaluates the golden result of a graph, transforms it and
+checks the outputs stay the same.
+*/
+func checkEquivalence(t *testing.T, g *Graph, transform func(g *Graph)) {
+	t.Helper()
+
+	if err := g.EvaluateGolden(DefaultEvalOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	transform(g)
+
+	if err := g.EvaluateCompare(); err != nil {
+		t.Error(err)
+	}
+}
+
+/*
+countOps returns the number of operation nodes of each operation.
+*/
+func countOps(g *Graph) map[NodeOp]int {
+	counts := make(map[NodeOp]int)
+	for _, node := range g.operationNodes {
+		counts[node.op]++
+	}
+	return counts
+}
+
+// -----------------------------------------------------------------------------
+
+func TestLevelize(t *testing.T) {
+	// y[0] = x[0]*x[1] + x[1], y[1] = x[0]*x[1]
+	g := CreateGraph()
+	x0, x1 := getNode(t, g, "ARRx[0]"), getNode(t, g, "ARRx[1]")
+	mul := addOperation(t, g, "*", x0, x1)
+	add := addOperation(t, g, "+", mul, x1)
+	y0, y1 := getNode(t, g, "ARRy[0]"), getNode(t, g, "ARRy[1]")
+	y0.Receive(add)
+	y1.Receive(mul)
+	if err := g.Legalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if maxLevel := g.Levelize(); maxLevel != 3 {
+		t.Errorf("maximum level is %d, want 3", maxLevel)
+	}
+
+	for _, test := range []struct {
+		node     *Node
+		level    int
+		revLevel int
+	}{
+		{x0, 0, 3},
+		{x1, 0, 3},
+		{mul, 1, 2},
+		{add, 2, 1},
+		{y0, 3, 0},
+		{y1, 2, 0},
+	} {
+		if test.node.level != test.level {
+			t.Errorf("%s is at level %d, want %d", test.node.name, test.node.level, test.level)
+		}
+		if revLevel := g.ReverseLevel(test.node); revLevel != test.revLevel {
+			t.Errorf("%s is at reverse level %d, want %d", test.node.name, revLevel, test.revLevel)
+		}
+	}
+
+	// Every node comes after its fanins and the order is sorted by level
+	order := g.TopologicalOrder()
+	if len(order) != g.NumAllNodes() {
+		t.Fatalf("topological order has %d nodes, want %d", len(order), g.NumAllNodes())
+	}
+	position := make(map[*Node]int)
+	for i, n := range order {
+		position[n] = i
+		if i > 0 && order[i-1].level > n.level {
+			t.Errorf("%s at level %d comes after level %d", n.name, n.level, order[i-1].level)
+		}
+	}
+	for _, n := range order {
+		for _, fi := range n.fanins {
+			if position[fi] > position[n] {
+				t.Errorf("%s comes before its fanin %s", n.name, fi.name)
+			}
+		}
+	}
+}
+
+func TestLevelizeDeepChain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping a graph of a million nodes in short mode")
+	}
+
+	// A chain deep enough to overflow a recursive levelizer
+	const depth = 1000000
+
+	g := CreateGraph()
+	x := getNode(t, g, "ARRx[0]")
+	n := x
+	for i := 0; i < depth; i++ {
+		n = addOperation(t, g, "+", n, x)
+	}
+	y := getNode(t, g, "ARRy[0]")
+	y.Receive(n)
+
+	if maxLevel := g.Levelize(); maxLevel != depth+1 {
+		t.Errorf("maximum level is %d, want %d", maxLevel, depth+1)
+	}
+	if revLevel := g.ReverseLevel(x); revLevel != depth+1 {
+		t.Errorf("input is at reverse level %d, want %d", revLevel, depth+1)
+	}
+}
+
+func TestLegalizeCycle(t *testing.T) {
+	// t = (x[0] + t)*2 feeds itself through the variable t
+	g := CreateGraph()
+	x := getNode(t, g, "ARRx[0]")
+	v := getNode(t, g, "VARt")
+	add := addOperation(t, g, "+", x, v)
+	mul := addOperation(t, g, "*", add, getNode(t, g, "CON2"))
+	v.Receive(mul)
+	getNode(t, g, "ARRy[0]").Receive(mul)
+
+	err := g.Legalize()
+	if err == nil {
+		t.Fatal("no error for a graph with a cycle")
+	}
+	if !strings.Contains(err.Error(), add.name) && !strings.Contains(err.Error(), mul.name) {
+		t.Errorf("error %q names no node on the cycle", err)
+	}
+}
+
+func TestGraphErrors(t *testing.T) {
+	g := CreateGraph()
+
+	if _, err := g.AddOperationNode("tan"); err == nil {
+		t.Error("no error for an unsupported operation")
+	}
+	for _, name := range []string{"", "x", "FOO1", "OPR0"} {
+		if _, err := g.GetNodeByName(name); err == nil {
+			t.Errorf("no error for node name %q", name)
+		}
+	}
+	if g.NumAllNodes() != 0 {
+		t.Errorf("failed calls leave %d nodes in the graph", g.NumAllNodes())
+	}
+}
+
+func TestMergeShared(t *testing.T) {
+	// y[0] = x[0]*x[1] + 2.0 and y[0] = x[0]*2, with constants spelled differently
+	g := CreateGraph()
+	gx := getNode(t, g, "ARRx[0]")
+	gTwo := getNode(t, g, "CON2.0")
+	gMul := addOperation(t, g, "*", gx, getNode(t, g, "ARRx[1]"))
+	getNode(t, g, "ARRy[0]").Receive(addOperation(t, g, "+", gMul, gTwo))
+
+	m := CreateGraph()
+	mMul := addOperation(t, m, "*", getNode(t, m, "ARRx[0]"), getNode(t, m, "CON2"))
+	getNode(t, m, "ARRy[0]").Receive(mMul)
+
+	for _, graph := range []*Graph{g, m} {
+		if err := graph.Legalize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without postfixes the outputs and operations collide, and nothing is
+	// merged
+	if err := g.MergeShared(m); err == nil {
+		t.Fatal("no error for nodes existing in both graphs")
+	}
+
+	isInput := func(n *Node) bool { return n.kind == NodeKind_Input }
+	g.AddPostfixExcept("1", isInput)
+	m.AddPostfixExcept("2", isInput)
+	if err := g.MergeShared(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.inputNodes["ARRx[0]"] != gx {
+		t.Error("input ARRx[0] is not shared")
+	}
+	if mMul.Fanin(0) != gx || mMul.Fanin(1) != gTwo {
+		t.Error("the product of the second graph doesn't read the shared nodes")
+	}
+	if g.NumInputNodes() != 2 || g.NumConstantNodes() != 1 || g.NumOutputNodes() != 2 {
+		t.Errorf("merged graph has %d inputs, %d constants and %d outputs, want 2, 1 and 2",
+			g.NumInputNodes(), g.NumConstantNodes(), g.NumOutputNodes())
+	}
+
+	gx.value, g.inputNodes["ARRx[1]"].value = 3, 5
+	if err := g.Eval(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]float64{"ARRy[0]_1": 17, "ARRy[0]_2": 6} {
+		if value := g.outputNodes[name].value; value != want {
+			t.Errorf("%s is %v, want %v", name, value, want)
+		}
+	}
+}
+
+func TestMergeSharedFanouts(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0]*x[1]", "y[1] = x[0] + 2")
+	m := buildTestGraph(t, "y[0] = x[0]*3")
+
+	isInput := func(n *Node) bool { return n.kind == NodeKind_Input }
+	g.AddPostfixExcept("_1", isInput)
+	m.AddPostfixExcept("_2", isInput)
+	if err := g.MergeShared(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shared input fans out to both graphs, the second graph only counts
+	// its own fanout
+	x := getNode(t, g, "ARRx[0]")
+	if m.inputNodes["ARRx[0]"] != x {
+		t.Fatal("ARRx[0] is not shared")
+	}
+	if x.NumFanouts() != 3 || g.numLocalFanouts(x) != 3 || m.numLocalFanouts(x) != 1 {
+		t.Errorf("got %d fanouts, %d in the merged graph and %d in the second graph, want 3, 3 and 1",
+			x.NumFanouts(), g.numLocalFanouts(x), m.numLocalFanouts(x))
+	}
+}
+
+func TestExtractOutputs(t *testing.T) {
+	// y[0] = x[0]*x[1] + x[2], y[1] = x[0]*x[1]*x[3], y[2] = sin(x[4])
+	g := CreateGraph()
+	mul := addOperation(t, g, "*", getNode(t, g, "ARRx[0]"), getNode(t, g, "ARRx[1]"))
+	getNode(t, g, "ARRy[0]").Receive(addOperation(t, g, "+", mul, getNode(t, g, "ARRx[2]")))
+	getNode(t, g, "ARRy[1]").Receive(addOperation(t, g, "*", mul, getNode(t, g, "ARRx[3]")))
+	getNode(t, g, "ARRy[2]").Receive(addOperation(t, g, "sin", getNode(t, g, "ARRx[4]")))
+	if err := g.Legalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.EvaluateGolden(DefaultEvalOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := g.ExtractOutputs([]string{"ARRy[1]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the cone of y[1] is left, the shared product is copied
+	for _, name := range []string{"ARRx[0]", "ARRx[1]", "ARRx[3]", "ARRy[1]", mul.name} {
+		if e.allNodes[name] == nil {
+			t.Errorf("%s is missing", name)
+		} else if e.allNodes[name] == g.allNodes[name] {
+			t.Errorf("%s is not copied", name)
+		}
+	}
+	if e.NumAllNodes() != 6 || e.NumOperationNodes() != 2 {
+		t.Errorf("extracted graph has %d nodes and %d operations, want 6 and 2",
+			e.NumAllNodes(), e.NumOperationNodes())
+	}
+	if len(g.allNodes[mul.name].fanouts) != 2 {
+		t.Error("extraction changes the original graph")
+	}
+
+	// Golden values of the remaining outputs come along
+	if err := e.EvaluateCompare(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := g.ExtractOutputs([]string{"ARRy[1]", "ARRy[9]"}); err == nil {
+		t.Error("no error for an unknown output")
+	}
+}
+
+func TestHashConsing(t *testing.T) {
+	assignments := []string{
+		"y[0] = sin(x[0]) + sin(x[0])*x[1]",
+		// Operands in another order are a different operation
+		"y[1] = x[1]*sin(x[0])",
+		"y[2] = sin(x[0])*x[1]",
+	}
+
+	g := CreateGraph()
+	g.EnableHashConsing()
+	for _, assignment := range assignments {
+		if err := addTestAssignment(g, assignment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Legalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sine is shared 3 times and the product sin(x[0])*x[1] once
+	if n := g.NumSharedOperations(); n != 4 {
+		t.Errorf("got %d shared operations, want 4", n)
+	}
+	want := map[NodeOp]int{NodeOp_Sin: 1, NodeOp_Mul: 2, NodeOp_Add: 1}
+	if ops := countOps(g); !reflect.DeepEqual(ops, want) {
+		t.Errorf("got operations %v, want %v", ops, want)
+	}
+
+	// The outputs are the same as without hash consing
+	unshared := buildTestGraph(t, assignments...)
+	for _, graph := range []*Graph{g, unshared} {
+		if err := graph.EvaluateGolden(DefaultEvalOptions()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(g.outputValues, unshared.outputValues) {
+		t.Errorf("got outputs %v, want %v", g.outputValues, unshared.outputValues)
+	}
+
+	// Hash consing ends when the graph is legalized
+	x := getNode(t, g, "ARRx[0]")
+	if sin, err := g.GetOperationNode("sin", x); err != nil || sin.NumFanouts() != 0 {
+		t.Errorf("got existing node %v after legalize, error %v", sin, err)
+	}
+	if _, err := g.GetOperationNode("tan", x); err == nil {
+		t.Errorf("got no error for an unsupported operation")
+	}
+}
@@ -3,6 +3,8 @@ package forge
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 )
 
 /*
@@ -13,7 +15,8 @@ type Node struct {
 	kind NodeKind
 	op   NodeOp
 
-	level int
+	level    int
+	revLevel int
 
 	fanins  []*Node
 	fanouts []*Node
@@ -21,6 +24,8 @@ type Node struct {
 	faninSigns []bool
 
 	value float64
+	// The second output value of a multi-output operation
+	secondValue float64
 
 	isScheduled bool
 	pgScheduled int
@@ -48,6 +53,39 @@ func CreateNode(name string, kind NodeKind, op NodeOp) *Node {
 	return node
 }
 
+/*
+VariableName returns the name of the source variable of an input or output node,
+for example "var1" for the node ARRvar1[3].
+*/
+func (n *Node) VariableName() string {
+	name := n.name[3:]
+
+	if i := strings.Index(name, "["); i >= 0 {
+		name = name[:i]
+	}
+
+	return name
+}
+
+/*
+ArrayIndex returns the array index of an input or output node, for example 3 for
+the node ARRvar1[3], or -1 if the node is not an array element.
+*/
+func (n *Node) ArrayIndex() int {
+	start := strings.Index(n.name, "[")
+	stop := strings.Index(n.name, "]")
+	if start < 0 || stop < start {
+		return -1
+	}
+
+	index, err := strconv.Atoi(n.name[start+1 : stop])
+	if err != nil {
+		return -1
+	}
+
+	return index
+}
+
 // Fanin
 // -----------------------------------------------------------------------------
 
@@ -137,30 +175,90 @@ func (n *Node) NegateFaninByNode(fi *Node) {
 }
 
 /*
-PropagateSign propagates fanin signs to the fanout.
-Negates the fanout of an addition if both fanins are negative.
-Negates the fanout of a multiply and division if one of the fanins is negative.
+PropagateSign moves fanin signs toward the fanouts where the operation allows,
+and returns true if any sign is changed. Signs end up on edges to adders, which
+absorb a single negated fanin by subtracting, or to outputs.
+
+	-a+(-b) = -(a+b), a single negated fanin stays
+	(-a)*b = -(a*b), (-a)*(-b) = a*b, and the same for division
+	Power(-x,k) = Power(x,k) for an even integer k, -Power(x,k) for an odd k
+	sin(-x) = -sin(x), cos(-x) = cos(x)
+	sincos(-x) negates the sine output only
+
+Signs of other operations, such as the fanin of a square root, can't be moved.
 */
-func (n *Node) PropagateSign() {
+func (n *Node) PropagateSign() bool {
 	switch n.op {
 	case NodeOp_Add:
 		if n.faninSigns[0] && n.faninSigns[1] {
 			n.faninSigns[0], n.faninSigns[1] = false, false
-
-			for _, fo := range n.fanouts {
-				fo.NegateFaninByNode(n)
-			}
+			n.negateFanouts()
+			return true
 		}
 	case NodeOp_Mul, NodeOp_Div:
-		if n.faninSigns[0] && !n.faninSigns[1] ||
-			!n.faninSigns[0] && n.faninSigns[1] {
+		if n.faninSigns[0] || n.faninSigns[1] {
+			if n.faninSigns[0] != n.faninSigns[1] {
+				n.negateFanouts()
+			}
 			n.faninSigns[0], n.faninSigns[1] = false, false
+			return true
+		}
+	case NodeOp_Power:
+		exponent := n.Fanin(1)
+		if !n.faninSigns[0] || exponent.kind != NodeKind_Constant ||
+			exponent.value != math.Trunc(exponent.value) {
+			return false
+		}
 
+		n.faninSigns[0] = false
+		if math.Mod(exponent.value, 2) != 0 {
+			n.negateFanouts()
+		}
+		return true
+	case NodeOp_Sin, NodeOp_SinCosSin, NodeOp_SinCosCos:
+		// Projections of a sincos pass a sign through
+		if n.faninSigns[0] {
+			n.faninSigns[0] = false
+			n.negateFanouts()
+			return true
+		}
+	case NodeOp_Cos:
+		if n.faninSigns[0] {
+			n.faninSigns[0] = false
+			return true
+		}
+	case NodeOp_SinCos:
+		if n.faninSigns[0] {
+			n.faninSigns[0] = false
 			for _, fo := range n.fanouts {
-				fo.NegateFaninByNode(n)
+				if fo.op == NodeOp_SinCosSin {
+					fo.negateFanouts()
+				}
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+negateFanouts negates every edge from the node to its fanouts, including all
+edges to a fanout that uses the node more than once.
+*/
+func (n *Node) negateFanouts() {
+	negated := make(map[*Node]bool)
+
+	for _, fo := range n.fanouts {
+		if negated[fo] {
+			continue
+		}
+		negated[fo] = true
+
+		for i, fi := range fo.fanins {
+			if fi == n {
+				fo.faninSigns[i] = !fo.faninSigns[i]
 			}
-		} else if !n.faninSigns[0] && !n.faninSigns[1] {
-			n.faninSigns[0], n.faninSigns[1] = false, false
 		}
 	}
 }
@@ -223,7 +321,7 @@ func (n *Node) Receive(fi *Node) {
 // -----------------------------------------------------------------------------
 
 // Eval evaluates the node's value based on its operation and fanins' value
-func (n *Node) Eval() {
+func (n *Node) Eval() error {
 	signs := []float64{}
 	for _, sign := range n.faninSigns {
 		if sign {
@@ -235,22 +333,37 @@ func (n *Node) Eval() {
 
 	switch n.op {
 	case NodeOp_Equal:
-		n.value = n.Fanin(0).value
+		n.value = signs[0] * n.Fanin(0).value
 	case NodeOp_Add:
 		n.value = (signs[0] * n.Fanin(0).value) + (signs[1] * n.Fanin(1).value)
 	case NodeOp_Sub:
-		fmt.Println("node eval error - should not contain subtraction")
+		return fmt.Errorf("node %s should not contain subtraction", n.name)
 	case NodeOp_Mul:
 		n.value = (signs[0] * n.Fanin(0).value) * (signs[1] * n.Fanin(1).value)
 	case NodeOp_Div:
 		n.value = (signs[0] * n.Fanin(0).value) / (signs[1] * n.Fanin(1).value)
 	case NodeOp_Power:
 		n.value = math.Pow(signs[0]*n.Fanin(0).value, signs[1]*n.Fanin(1).value)
+	case NodeOp_Sqrt:
+		n.value = math.Sqrt(signs[0] * n.Fanin(0).value)
+	case NodeOp_Exp:
+		n.value = math.Exp(signs[0] * n.Fanin(0).value)
+	case NodeOp_Log:
+		n.value = math.Log(signs[0] * n.Fanin(0).value)
 	case NodeOp_Sin:
 		n.value = math.Sin(signs[0] * n.Fanin(0).value)
 	case NodeOp_Cos:
 		n.value = math.Cos(signs[0] * n.Fanin(0).value)
+	case NodeOp_SinCos:
+		n.value = math.Sin(signs[0] * n.Fanin(0).value)
+		n.secondValue = math.Cos(signs[0] * n.Fanin(0).value)
+	case NodeOp_SinCosSin:
+		n.value = signs[0] * n.Fanin(0).value
+	case NodeOp_SinCosCos:
+		n.value = signs[0] * n.Fanin(0).secondValue
 	default:
-		fmt.Println("node eval error - unsupported operation", NodeOpStringLUT[n.op])
+		return fmt.Errorf("node %s has unsupported operation %s", n.name, NodeOpStringLUT[n.op])
 	}
+
+	return nil
 }
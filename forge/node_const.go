@@ -16,6 +16,18 @@ const (
 	NodeKind_Constant
 )
 
+/*
+NodeKindStringLUT is a lookup table for converting a NodeKind to a string.
+*/
+var NodeKindStringLUT = map[NodeKind]string{
+	NodeKind_Undetermined: "undetermined",
+	NodeKind_Input:        "input",
+	NodeKind_Output:       "output",
+	NodeKind_Internal:     "internal",
+	NodeKind_Operation:    "operation",
+	NodeKind_Constant:     "constant",
+}
+
 // -----------------------------------------------------------------------------
 
 /*
@@ -44,6 +56,13 @@ const (
 	NodeOp_Sinh
 	NodeOp_Cosh
 	NodeOp_Tanh
+
+	// A sincos operation computes sine and cosine of the same argument at once,
+	// it has two outputs that are selected by the sincos.sin and sincos.cos
+	// operations, which take no time and need no process element.
+	NodeOp_SinCos
+	NodeOp_SinCosSin
+	NodeOp_SinCosCos
 )
 
 // -----------------------------------------------------------------------------
@@ -69,7 +88,7 @@ func init() {
 	NodeOpLUT["*"] = NodeOp_Mul
 	NodeOpLUT["/"] = NodeOp_Div
 	NodeOpLUT["power"] = NodeOp_Power
-	//NodeOpLUT["sqrt"] = NodeOp_Sqrt
+	NodeOpLUT["sqrt"] = NodeOp_Sqrt
 	//NodeOpLUT["abs"] = NodeOp_Abs
 	//NodeOpLUT["exp"] = NodeOp_Exp
 	//NodeOpLUT["log"] = NodeOp_Log
@@ -90,10 +109,10 @@ func init() {
 	NodeOpStringLUT[NodeOp_Mul] = "*"
 	NodeOpStringLUT[NodeOp_Div] = "/"
 	NodeOpStringLUT[NodeOp_Power] = "power"
-	//NodeOpStringLUT[NodeOp_Sqrt] = "sqrt"
+	NodeOpStringLUT[NodeOp_Sqrt] = "sqrt"
 	//NodeOpStringLUT[NodeOp_Abs] = "abs"
-	//NodeOpStringLUT[NodeOp_Exp] = "exp"
-	//NodeOpStringLUT[NodeOp_Log] = "log"
+	NodeOpStringLUT[NodeOp_Exp] = "exp"
+	NodeOpStringLUT[NodeOp_Log] = "log"
 	NodeOpStringLUT[NodeOp_Sin] = "sin"
 	NodeOpStringLUT[NodeOp_Cos] = "cos"
 	//NodeOpStringLUT[NodeOp_Tan] = "tan"
@@ -103,4 +122,7 @@ func init() {
 	//NodeOpStringLUT[NodeOp_Sinh] = "sinh"
 	//NodeOpStringLUT[NodeOp_Cosh] = "cosh"
 	//NodeOpStringLUT[NodeOp_Tanh] = "tanh"
+	NodeOpStringLUT[NodeOp_SinCos] = "sincos"
+	NodeOpStringLUT[NodeOp_SinCosSin] = "sincos.sin"
+	NodeOpStringLUT[NodeOp_SinCosCos] = "sincos.cos"
 }
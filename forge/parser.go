@@ -14,6 +14,9 @@ type Parser struct {
 	parserStack
 
 	graph *Graph
+
+	// Build repeated operations on the same operands only once
+	hashConsing bool
 }
 
 /*
@@ -21,6 +24,9 @@ Parse parses a C++ source file and builds a corresponding graph.
 */
 func (p *Parser) Parse(fname string) (*Graph, error) {
 	p.graph = CreateGraph()
+	if p.hashConsing {
+		p.graph.EnableHashConsing()
+	}
 
 	// Create a new index to store translation units
 	//  arg1: exclude declarations from precompiled header
@@ -51,6 +57,9 @@ func (p *Parser) Parse(fname string) (*Graph, error) {
 
 	inTargetFunc := false
 
+	// Error from the parser sub-functions, which stops the traversal
+	var parseErr error
+
 	cursor := tu.TranslationUnitCursor()
 
 	// Recursively traverse the source file and build the graph
@@ -68,21 +77,17 @@ func (p *Parser) Parse(fname string) (*Graph, error) {
 		if inTargetFunc {
 			switch cursor.Kind().Spelling() {
 			case "DeclRefExpr":
-				if !p.parseDeclRefExpr(cursor) {
-					return clang.ChildVisit_Break
-				}
+				parseErr = p.parseDeclRefExpr(cursor)
 			case "ArraySubscriptExpr":
-				if !p.parseArraySubscriptExpr(cursor) {
-					return clang.ChildVisit_Break
-				}
+				parseErr = p.parseArraySubscriptExpr(cursor)
 			case "IntegerLiteral", "FloatingLiteral":
-				if !p.parseLiteral(cursor) {
-					return clang.ChildVisit_Break
-				}
+				parseErr = p.parseLiteral(cursor)
 			case "UnaryOperator", "BinaryOperator":
-				if !p.parseOperator(cursor) {
-					return clang.ChildVisit_Break
-				}
+				parseErr = p.parseOperator(cursor)
+			}
+
+			if parseErr != nil {
+				return clang.ChildVisit_Break
 			}
 		}
 
@@ -90,11 +95,16 @@ func (p *Parser) Parse(fname string) (*Graph, error) {
 	})
 
 	// Source file traversal failed
+	if parseErr != nil {
+		return nil, fmt.Errorf("problem building graph for %s: %v", fname, parseErr)
+	}
 	if !buildOk {
 		return nil, fmt.Errorf("problem building graph for %s", fname)
 	}
 
-	p.graph.Legalize()
+	if err := p.graph.Legalize(); err != nil {
+		return nil, fmt.Errorf("problem building graph for %s: %v", fname, err)
+	}
 
 	fmt.Println(fname)
 
@@ -107,7 +117,7 @@ func (p *Parser) Parse(fname string) (*Graph, error) {
 /*
 parseDeclRefExpr parses references to a declared expression.
 */
-func (p *Parser) parseDeclRefExpr(cursor clang.Cursor) bool {
+func (p *Parser) parseDeclRefExpr(cursor clang.Cursor) error {
 	cursorType := cursor.Type().Spelling()
 
 	// It's a reference to a function
@@ -123,9 +133,8 @@ func (p *Parser) parseDeclRefExpr(cursor clang.Cursor) bool {
 
 		// Only support functions with up to 2 parameters
 		if numParms > 2 {
-			fmt.Printf("parse error - support functions with up to 2 parameters")
-
-			return false
+			return fmt.Errorf("function %s has %d parameters, only support up to 2",
+				cursor.Spelling(), numParms)
 		}
 
 		// Push a non-leaf FUN token to the stack
@@ -134,46 +143,65 @@ func (p *Parser) parseDeclRefExpr(cursor clang.Cursor) bool {
 		// Push a leaf VAR token to the stack
 		p.pushLeafToken("VAR" + cursor.Spelling())
 		// Process the stack whenever a leaf token is pushed
-		p.processStack()
+		return p.processStack()
 	}
 
-	return true
+	return nil
 }
 
 /*
 parseArraySubscriptExpr parses array expressions.
 */
-func (p *Parser) parseArraySubscriptExpr(cursor clang.Cursor) bool {
+func (p *Parser) parseArraySubscriptExpr(cursor clang.Cursor) error {
 	// Push a non-leaf ARR token to the stack
 	p.pushNonLeafToken("ARR", 2)
 
-	return true
+	return nil
 }
 
 /*
 parseLiternal parses literals.
 */
-func (p *Parser) parseLiteral(cursor clang.Cursor) bool {
+func (p *Parser) parseLiteral(cursor clang.Cursor) error {
 	switch cursor.Kind().Spelling() {
 	case "IntegerLiteral":
 		p.pushLeafToken("CON" + cursor.LiteralSpelling())
 		// Process the stack whenever a leaf token is pushed
-		p.processStack()
+		return p.processStack()
 	case "FloatingLiteral":
-		// Remove trailing zeros and decimal point, for example
-		// 1.200 becomes 1,2 and 3.0 become 3
-		p.pushLeafToken("CON" + strings.TrimRight(cursor.LiteralSpelling(), "0."))
+		p.pushLeafToken("CON" + trimFloatLiteral(cursor.LiteralSpelling()))
 		// Process the stack whenever a leaf token is pushed
-		p.processStack()
+		return p.processStack()
 	}
 
-	return true
+	return nil
+}
+
+/*
+trimFloatLiteral removes trailing zeros after the decimal point and then a
+trailing decimal point, for example 1.200 becomes 1.2, 3.0 becomes 3 and 10.
+becomes 10. Literals with an exponent or in hexadecimal are kept as they are.
+*/
+func trimFloatLiteral(spelling string) string {
+	if !strings.Contains(spelling, ".") || strings.ContainsAny(spelling, "eEpPxX") {
+		return spelling
+	}
+
+	spelling = strings.TrimRight(spelling, "0")
+	spelling = strings.TrimSuffix(spelling, ".")
+
+	// A literal such as .0 has no digit left
+	if spelling == "" {
+		return "0"
+	}
+
+	return spelling
 }
 
 /*
 parseOperator parses operators.
 */
-func (p *Parser) parseOperator(cursor clang.Cursor) bool {
+func (p *Parser) parseOperator(cursor clang.Cursor) error {
 	switch cursor.Kind().Spelling() {
 	case "UnaryOperator":
 		p.pushNonLeafToken("UOP"+cursor.OperatorSpelling(), 1)
@@ -181,7 +209,7 @@ func (p *Parser) parseOperator(cursor clang.Cursor) bool {
 		p.pushNonLeafToken("BOP"+cursor.OperatorSpelling(), 2)
 	}
 
-	return true
+	return nil
 }
 
 // -----------------------------------------------------------------------------
@@ -190,7 +218,7 @@ func (p *Parser) parseOperator(cursor clang.Cursor) bool {
 processStack is invoked when a leaf token is pushed to the stack, and it checks
 the stack to see if tokens are ready to be popped and processed.
 */
-func (p *Parser) processStack() {
+func (p *Parser) processStack() error {
 	// Loop whenever a token is ready to be popped
 	for p.tokenReady() {
 		// Pop the token and its arguments from the stack
@@ -202,58 +230,82 @@ func (p *Parser) processStack() {
 		switch token[0:3] {
 		default:
 		case "ARR":
-			operand := p.graph.GetNodeByName("ARR" + args[0][3:] + "[" + args[1][3:] + "]")
+			operand, err := p.graph.GetNodeByName("ARR" + args[0][3:] + "[" + args[1][3:] + "]")
+			if err != nil {
+				return err
+			}
 
 			p.pushLeafToken(operand.name)
 		case "BOP":
 			opcode := token[3:]
 
-			lOperand := p.graph.GetNodeByName(args[0])
-			rOperand := p.graph.GetNodeByName(args[1])
+			operands, err := p.getOperands(args)
+			if err != nil {
+				return err
+			}
 
 			if opcode == "=" {
-				lOperand.Receive(rOperand)
+				operands[0].Receive(operands[1])
 			} else {
-				opNode := p.graph.AddOperationNode(opcode)
-				opNode.Receive(lOperand)
-				opNode.Receive(rOperand)
+				opNode, err := p.graph.GetOperationNode(opcode, operands...)
+				if err != nil {
+					return err
+				}
 
 				p.pushLeafToken(opNode.name)
 			}
 		case "UOP":
 			opcode := token[3:]
 
-			if opcode == "-" {
-				operand := p.graph.GetNodeByName(args[0])
+			if opcode != "-" {
+				return fmt.Errorf("unsupported unary operator %s, only support -", opcode)
+			}
 
-				opNode := p.graph.AddOperationNode(opcode)
-				opNode.Receive(operand)
+			operands, err := p.getOperands(args)
+			if err != nil {
+				return err
+			}
 
-				p.pushLeafToken(opNode.name)
-			} else {
-				fmt.Println("parser error - only support - unary operator")
+			opNode, err := p.graph.GetOperationNode(opcode, operands...)
+			if err != nil {
+				return err
 			}
+
+			p.pushLeafToken(opNode.name)
 		case "FUN":
 			funcName := strings.ToLower(token[3:])
-			numParms := len(args)
 
-			if numParms == 2 {
-				operand1 := p.graph.GetNodeByName(args[0])
-				operand2 := p.graph.GetNodeByName(args[1])
+			operands, err := p.getOperands(args)
+			if err != nil {
+				return err
+			}
 
-				opNode := p.graph.AddOperationNode(funcName)
-				opNode.Receive(operand1)
-				opNode.Receive(operand2)
+			opNode, err := p.graph.GetOperationNode(funcName, operands...)
+			if err != nil {
+				return err
+			}
 
-				p.pushLeafToken(opNode.name)
-			} else {
-				operand := p.graph.GetNodeByName(args[0])
+			p.pushLeafToken(opNode.name)
+		}
+	}
 
-				opNode := p.graph.AddOperationNode(funcName)
-				opNode.Receive(operand)
+	return nil
+}
 
-				p.pushLeafToken(opNode.name)
-			}
+/*
+getOperands gets the nodes for the arguments of a popped token.
+*/
+func (p *Parser) getOperands(args []string) ([]*Node, error) {
+	operands := make([]*Node, len(args))
+
+	for i, arg := range args {
+		operand, err := p.graph.GetNodeByName(arg)
+		if err != nil {
+			return nil, err
 		}
+
+		operands[i] = operand
 	}
+
+	return operands, nil
 }
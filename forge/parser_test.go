@@ -0,0 +1,28 @@
+package forge
+
+import "testing"
+
+func TestTrimFloatLiteral(t *testing.T) {
+	tests := []struct {
+		spelling string
+		want     string
+	}{
+		{"1.200", "1.2"},
+		{"3.0", "3"},
+		{"10.", "10"},
+		{"100.0", "100"},
+		{"0.", "0"},
+		{"0.0", "0"},
+		{".0", "0"},
+		{".50", ".5"},
+		{"1.0e10", "1.0e10"},
+		{"2.50E-3", "2.50E-3"},
+		{"0x1.0p0", "0x1.0p0"},
+	}
+
+	for _, test := range tests {
+		if got := trimFloatLiteral(test.spelling); got != test.want {
+			t.Errorf("trimFloatLiteral(%q) = %q, want %q", test.spelling, got, test.want)
+		}
+	}
+}
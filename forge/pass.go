@@ -0,0 +1,453 @@
+package forge
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Pass is a graph transformation run by the PassManager.
+*/
+type Pass interface {
+	// Name returns the name used to refer to the pass in a pipeline
+	Name() string
+	// Run transforms the graph and returns the number of changes it made, a pass
+	// returning 0 ends the fixed-point iteration it's in. An error stops the
+	// pipeline.
+	Run(g *Graph) (int, error)
+}
+
+/*
+ReportingPass is a pass that adds details of its last run, such as operations it
+left untransformed, to the report of the run.
+*/
+type ReportingPass interface {
+	Pass
+	Report(report *PassReport)
+}
+
+/*
+PassOptions holds options shared by passes.
+*/
+type PassOptions struct {
+	// Allow transformations that change floating point results slightly
+	FastMath bool
+	// Lower powers with non-integer exponents to exp and log
+	LowerExpLog bool
+	// Maximum estimated relative error of reassociating a sum when balancing
+	// trees, no limit if 0
+	MaxReassociationError float64
+	// Random inputs used to estimate reassociation errors
+	Samples EvalOptions
+	// Processor whose process elements are the cost model of the e-graph
+	// optimizer, the default processor if nil
+	Processor *Processor
+	// Maximum number of e-nodes of the e-graph optimizer, the default if 0
+	EGraphNodeBudget int
+	// User-defined rules applied by the rewrite pass
+	RewriteRules []*RewriteRule
+}
+
+/*
+PassReport records the result of a pass run.
+*/
+type PassReport struct {
+	Name     string
+	Duration time.Duration
+
+	NumNodesBefore int
+	NumNodesAfter  int
+	NumChanges     int
+
+	// Notes of the pass on the run, for example operations it left untransformed
+	Messages []string
+	// Applications of each rule by the rewrite pass
+	Rules []RewriteReport
+}
+
+/*
+addMessage adds a formatted message to the report.
+*/
+func (r *PassReport) addMessage(format string, args ...interface{}) {
+	r.Messages = append(r.Messages, fmt.Sprintf(format, args...))
+}
+
+/*
+OptLevelPipelines are the pipelines of optimization levels -O0 to -O3.
+
+Passes in parentheses are iterated until none of them changes the graph, which
+lets simplification and common subexpression elimination enable each other from
+-O1 on. -O1 has the passes graphs were always optimized with before optimization
+levels were added, the rewrite pass in it changes nothing unless rules are
+loaded. The egraph pass is only in -O3, its run time grows quickly with the
+size of the graph and is bounded by the e-node budget, see
+PassOptions.EGraphNodeBudget.
+*/
+var OptLevelPipelines = []string{
+	"",
+	"simplify,rewrite,(simplify,cse),balance,dce",
+	"fold,simplify,rewrite,cse,poly,power,(simplify,cse,factor),reciprocal,sincos,balance,sign,dce",
+	"fold,simplify,rewrite,cse,poly,(simplify,power,cse,factor),egraph,reciprocal,sincos,(simplify,cse),balance-latency,sign,dce",
+}
+
+/*
+DefaultOptLevel is the optimization level used if none is specified. It runs the
+passes graphs were optimized with before optimization levels were added, so the
+default build gets no new transformations, but value numbering and fixed-point
+iteration of simplify and cse can remove operations the old passes left.
+*/
+const DefaultOptLevel = 1
+
+// maxFixedPointIterations bounds fixed-point iterations in case passes keep
+// undoing each other
+const maxFixedPointIterations = 100
+
+// -----------------------------------------------------------------------------
+
+/*
+graphPass adapts a function to the Pass interface. The function adds details of
+the run to a report, which is kept until the next run.
+*/
+type graphPass struct {
+	name string
+	run  func(g *Graph, report *PassReport) (int, error)
+
+	last PassReport
+}
+
+func (p *graphPass) Name() string { return p.name }
+
+func (p *graphPass) Run(g *Graph) (int, error) {
+	p.last = PassReport{}
+	return p.run(g, &p.last)
+}
+
+func (p *graphPass) Report(report *PassReport) {
+	report.Messages = append(report.Messages, p.last.Messages...)
+	report.Rules = append(report.Rules, p.last.Rules...)
+}
+
+/*
+CreatePass creates the pass with the given name.
+*/
+func CreatePass(name string, options PassOptions) (Pass, error) {
+	var run func(g *Graph, report *PassReport) (int, error)
+
+	// changes adapts a transformation that only returns the number of changes
+	changes := func(transform func(g *Graph) int) func(*Graph, *PassReport) (int, error) {
+		return func(g *Graph, report *PassReport) (int, error) { return transform(g), nil }
+	}
+
+	switch name {
+	case "fold":
+		run = changes((*Graph).FoldConstants)
+	case "simplify":
+		run = changes((*Graph).SimplifyArithmetic)
+	case "poly":
+		run = changes((*Graph).RewritePolynomials)
+	case "power":
+		run = func(g *Graph, report *PassReport) (int, error) {
+			numPowers := g.numOperations(NodeOp_Power)
+			if unreduced := g.ReducePower(options.LowerExpLog); len(unreduced) > 0 {
+				report.addMessage("%d power operations are not reduced", len(unreduced))
+			}
+			return numPowers - g.numOperations(NodeOp_Power), nil
+		}
+	case "rewrite":
+		run = func(g *Graph, report *PassReport) (int, error) {
+			rules, err := g.ApplyRewriteRules(options.RewriteRules, options.Samples)
+			if err != nil {
+				return 0, fmt.Errorf("rules are not applied, %v", err)
+			}
+			report.Rules = rules
+
+			numFired := 0
+			for _, rule := range rules {
+				numFired += rule.NumFired
+			}
+			return numFired, nil
+		}
+	case "cse":
+		run = changes((*Graph).EliminateDuplicatedOperation)
+	case "factor":
+		run = changes((*Graph).FactorizeSums)
+	case "reciprocal":
+		run = changes(func(g *Graph) int { return g.ShareReciprocals(options.FastMath) })
+	case "sincos":
+		run = changes((*Graph).FuseSinCos)
+	case "balance", "balance-latency":
+		byLatency := name == "balance-latency"
+
+		run = func(g *Graph, report *PassReport) (int, error) {
+			if options.MaxReassociationError == 0 {
+				g.maximizeParallelism(byLatency, nil)
+				return 0, nil
+			}
+
+			numRefused, err := g.MaximizeParallelismWithinError(byLatency,
+				options.MaxReassociationError, options.Samples)
+			if err != nil {
+				return 0, fmt.Errorf("trees are not balanced, %v", err)
+			}
+			if numRefused > 0 {
+				report.addMessage("%d sums are not balanced to limit rounding errors", numRefused)
+			}
+			return 0, nil
+		}
+	case "egraph":
+		processor, nodeBudget := options.Processor, options.EGraphNodeBudget
+		if processor == nil {
+			processor = CreateProcessor()
+		}
+		if nodeBudget == 0 {
+			nodeBudget = DefaultEGraphNodeBudget
+		}
+
+		run = changes(func(g *Graph) int { return g.OptimizeByEGraph(processor, nodeBudget) })
+	case "sign":
+		run = changes((*Graph).CanonicalizeSigns)
+	case "dce":
+		run = func(g *Graph, report *PassReport) (int, error) {
+			numDeleted, deletedInputs := g.EliminateDeadCode()
+			if len(deletedInputs) > 0 {
+				report.addMessage("%d unused inputs are eliminated: %s",
+					len(deletedInputs), strings.Join(deletedInputs, ", "))
+			}
+			return numDeleted, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown pass %q", name)
+	}
+
+	return &graphPass{name: name, run: run}, nil
+}
+
+// -----------------------------------------------------------------------------
+
+/*
+PassManager runs a pipeline of passes on graphs.
+*/
+type PassManager struct {
+	options PassOptions
+
+	// Each group of passes is iterated until none of them changes the graph if
+	// it's a fixed-point group, otherwise it runs once
+	groups     [][]Pass
+	fixedPoint []bool
+
+	// Check the graph against its golden result after every pass
+	verify      bool
+	evalOptions EvalOptions
+
+	reports  []PassReport
+	warnings []string
+}
+
+/*
+CreatePassManager creates and returns a pass manager with the pipeline of the
+default optimization level.
+*/
+func CreatePassManager(options PassOptions) *PassManager {
+	pm := &PassManager{options: options}
+
+	pm.SetPipeline(OptLevelPipelines[DefaultOptLevel])
+
+	return pm
+}
+
+/*
+SetOptLevel sets the pipeline to the one of an optimization level.
+*/
+func (pm *PassManager) SetOptLevel(level int) error {
+	if level < 0 || level >= len(OptLevelPipelines) {
+		return fmt.Errorf("unsupported optimization level %d", level)
+	}
+
+	return pm.SetPipeline(OptLevelPipelines[level])
+}
+
+/*
+SetPipeline sets the pipeline from a comma-separated list of pass names, for
+example "fold,(simplify,cse),balance". Passes in parentheses are iterated until
+none of them changes the graph.
+*/
+func (pm *PassManager) SetPipeline(spec string) error {
+	groups := [][]Pass{}
+	fixedPoint := []bool{}
+
+	inGroup := false
+
+	for _, field := range strings.Split(spec, ",") {
+		name := strings.TrimSpace(field)
+		if name == "" {
+			continue
+		}
+
+		// A group starts with "(" and ends with ")"
+		startGroup := strings.HasPrefix(name, "(")
+		endGroup := strings.HasSuffix(name, ")")
+		name = strings.TrimSpace(strings.Trim(name, "()"))
+
+		if startGroup {
+			if inGroup {
+				return fmt.Errorf("nested pass group in pipeline %q", spec)
+			}
+			inGroup = true
+
+			groups = append(groups, []Pass{})
+			fixedPoint = append(fixedPoint, true)
+		} else if !inGroup {
+			groups = append(groups, []Pass{})
+			fixedPoint = append(fixedPoint, false)
+		}
+
+		pass, err := CreatePass(name, pm.options)
+		if err != nil {
+			return err
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], pass)
+
+		if endGroup {
+			if !inGroup {
+				return fmt.Errorf("unbalanced parenthesis in pipeline %q", spec)
+			}
+			inGroup = false
+		}
+	}
+
+	if inGroup {
+		return fmt.Errorf("unbalanced parenthesis in pipeline %q", spec)
+	}
+
+	pm.groups = groups
+	pm.fixedPoint = fixedPoint
+
+	return nil
+}
+
+/*
+Verify makes Run() evaluate the graph with random inputs before the first pass
+and check that the outputs stay the same after every pass.
+*/
+func (pm *PassManager) Verify(enable bool, options EvalOptions) {
+	pm.verify = enable
+	pm.evalOptions = options
+}
+
+/*
+Pipeline returns the pipeline in the format accepted by SetPipeline().
+*/
+func (pm *PassManager) Pipeline() string {
+	fields := []string{}
+
+	for i, group := range pm.groups {
+		names := []string{}
+		for _, pass := range group {
+			names = append(names, pass.Name())
+		}
+
+		if pm.fixedPoint[i] {
+			fields = append(fields, "("+strings.Join(names, ",")+")")
+		} else {
+			fields = append(fields, names...)
+		}
+	}
+
+	return strings.Join(fields, ",")
+}
+
+/*
+Run runs the pipeline on the graph and records a report for each pass run.
+
+The pipeline stops at the first pass that fails, or if verification is enabled,
+at the first pass that changes the outputs, and an error naming the pass is
+returned. A group of passes that still changes the graph after
+maxFixedPointIterations iterations is left as it is, with a warning, see
+Warnings().
+*/
+func (pm *PassManager) Run(g *Graph) error {
+	pm.reports = nil
+	pm.warnings = nil
+
+	if pm.verify {
+		if err := g.EvaluateGolden(pm.evalOptions); err != nil {
+			return fmt.Errorf("problem evaluating golden result: %v", err)
+		}
+	}
+
+	for i, group := range pm.groups {
+		converged := false
+
+		for iteration := 0; iteration < maxFixedPointIterations; iteration++ {
+			numChanges := 0
+
+			for _, pass := range group {
+				n, err := pm.runPass(pass, g)
+				if err != nil {
+					return fmt.Errorf("pass %s failed: %v", pass.Name(), err)
+				}
+				numChanges += n
+
+				if pm.verify {
+					if err := g.EvaluateCompare(); err != nil {
+						return fmt.Errorf("pass %s broke equivalence: %v", pass.Name(), err)
+					}
+				}
+			}
+
+			if !pm.fixedPoint[i] || numChanges == 0 {
+				converged = true
+				break
+			}
+		}
+
+		if !converged {
+			names := []string{}
+			for _, pass := range group {
+				names = append(names, pass.Name())
+			}
+
+			pm.warnings = append(pm.warnings, fmt.Sprintf(
+				"passes (%s) still change the graph after %d iterations",
+				strings.Join(names, ","), maxFixedPointIterations))
+		}
+	}
+
+	return nil
+}
+
+/*
+runPass runs a pass and records its report.
+*/
+func (pm *PassManager) runPass(pass Pass, g *Graph) (int, error) {
+	report := PassReport{Name: pass.Name(), NumNodesBefore: g.NumAllNodes()}
+
+	start := time.Now()
+	numChanges, err := pass.Run(g)
+	report.Duration = time.Since(start)
+
+	report.NumChanges = numChanges
+	report.NumNodesAfter = g.NumAllNodes()
+	if reporting, ok := pass.(ReportingPass); ok {
+		reporting.Report(&report)
+	}
+	pm.reports = append(pm.reports, report)
+
+	return numChanges, err
+}
+
+/*
+Reports returns the reports of the passes run by the last Run().
+*/
+func (pm *PassManager) Reports() []PassReport {
+	return pm.reports
+}
+
+/*
+Warnings returns the warnings of the last Run(), such as a group of passes that
+didn't reach a fixed point.
+*/
+func (pm *PassManager) Warnings() []string {
+	return pm.warnings
+}
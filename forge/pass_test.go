@@ -0,0 +1,283 @@
+package forge
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetPipeline(t *testing.T) {
+	tests := []struct {
+		spec     string
+		pipeline string
+		err      string
+	}{
+		{"fold,(simplify,cse),balance", "fold,(simplify,cse),balance", ""},
+		{" fold , ( simplify , cse ) ,dce", "fold,(simplify,cse),dce", ""},
+		{"(simplify),dce", "(simplify),dce", ""},
+		{"", "", ""},
+		{"fold,loop-unroll", "", "unknown pass"},
+		{"(simplify,cse", "", "unbalanced parenthesis"},
+		{"simplify,cse)", "", "unbalanced parenthesis"},
+		{"(simplify,(cse),dce)", "", "nested pass group"},
+	}
+
+	for _, test := range tests {
+		pm := CreatePassManager(PassOptions{})
+		err := pm.SetPipeline(test.spec)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.spec, err, test.err)
+			}
+			// A bad pipeline leaves the previous one
+			if pm.Pipeline() != OptLevelPipelines[DefaultOptLevel] {
+				t.Errorf("%q: pipeline changed to %q", test.spec, pm.Pipeline())
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+		} else if pipeline := pm.Pipeline(); pipeline != test.pipeline {
+			t.Errorf("%q: got pipeline %q, want %q", test.spec, pipeline, test.pipeline)
+		}
+	}
+
+	pm := CreatePassManager(PassOptions{})
+	for level, pipeline := range OptLevelPipelines {
+		if err := pm.SetOptLevel(level); err != nil {
+			t.Errorf("-O%d: %v", level, err)
+		} else if pm.Pipeline() != pipeline {
+			t.Errorf("-O%d: got pipeline %q, want %q", level, pm.Pipeline(), pipeline)
+		}
+	}
+	if err := pm.SetOptLevel(len(OptLevelPipelines)); err == nil {
+		t.Errorf("-O%d: got no error", len(OptLevelPipelines))
+	}
+}
+
+// countingPass is a pass that reports changes for a number of runs
+type countingPass struct {
+	numRuns       int
+	numChangeRuns int
+}
+
+func (p *countingPass) Name() string { return "counting" }
+
+func (p *countingPass) Run(g *Graph) (int, error) {
+	p.numRuns++
+	if p.numRuns <= p.numChangeRuns {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func TestPassManagerFixedPoint(t *testing.T) {
+	once := &countingPass{numChangeRuns: 5}
+	converging := &countingPass{numChangeRuns: 2}
+	other := &countingPass{}
+	endless := &countingPass{numChangeRuns: 2 * maxFixedPointIterations}
+
+	pm := CreatePassManager(PassOptions{})
+	pm.groups = [][]Pass{{once}, {converging, other}, {endless}}
+	pm.fixedPoint = []bool{false, true, true}
+
+	if err := pm.Run(CreateGraph()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A group is iterated until a whole iteration makes no change, every pass
+	// of the group runs in the last iteration
+	if once.numRuns != 1 || converging.numRuns != 3 || other.numRuns != 3 {
+		t.Errorf("got runs %d, %d, %d, want 1, 3, 3", once.numRuns, converging.numRuns, other.numRuns)
+	}
+	if endless.numRuns != maxFixedPointIterations {
+		t.Errorf("got %d runs of a pass that never converges, want %d", endless.numRuns, maxFixedPointIterations)
+	}
+	if n := len(pm.Reports()); n != 1+6+maxFixedPointIterations {
+		t.Errorf("got %d reports, want %d", n, 1+6+maxFixedPointIterations)
+	}
+
+	// Only the group that never converges is warned about
+	if warnings := pm.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "(counting)") {
+		t.Errorf("got warnings %q, want one about the endless group", warnings)
+	}
+}
+
+// failingPass is a pass that fails after changing the graph
+type failingPass struct{}
+
+func (p failingPass) Name() string { return "failing" }
+
+func (p failingPass) Run(g *Graph) (int, error) { return 1, errors.New("broken") }
+
+func TestPassManagerFailure(t *testing.T) {
+	after := &countingPass{}
+
+	pm := CreatePassManager(PassOptions{})
+	pm.groups = [][]Pass{{&countingPass{}}, {failingPass{}}, {after}}
+	pm.fixedPoint = []bool{false, true, false}
+
+	// A failing pass stops the pipeline, its run is still reported
+	err := pm.Run(CreateGraph())
+	if err == nil || !strings.Contains(err.Error(), "pass failing failed: broken") {
+		t.Errorf("got error %v, want one naming the failing pass", err)
+	}
+	if after.numRuns != 0 {
+		t.Errorf("a pass after the failing pass ran")
+	}
+	if n := len(pm.Reports()); n != 2 {
+		t.Errorf("got %d reports, want 2", n)
+	}
+}
+
+func TestPassMessages(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0]*0 + x[1]", "y[1] = power(x[2], 1.5)")
+
+	pm := CreatePassManager(PassOptions{})
+	if err := pm.SetPipeline("simplify,power,dce"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.Run(g); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{nil, {"1 power operations are not reduced"}, {"1 unused inputs are eliminated: ARRx[0]"}}
+	for i, report := range pm.Reports() {
+		if !reflect.DeepEqual(report.Messages, want[i]) {
+			t.Errorf("%s: got messages %q, want %q", report.Name, report.Messages, want[i])
+		}
+	}
+
+	// Messages are of the last run only
+	if err := pm.Run(g); err != nil {
+		t.Fatal(err)
+	}
+	if messages := pm.Reports()[2].Messages; len(messages) != 0 {
+		t.Errorf("dce: got messages %q of the previous run", messages)
+	}
+}
+
+func TestPassManagerRun(t *testing.T) {
+	for level := range OptLevelPipelines {
+		g := buildTestGraph(t,
+			"y[0] = power(x[0], 3)*x[1] + power(x[0], 3)*x[2] + sin(x[3])/x[4]",
+			"y[1] = cos(x[3])/x[4] - (2 + 3)*x[1]*1")
+
+		pm := CreatePassManager(PassOptions{})
+		if err := pm.SetOptLevel(level); err != nil {
+			t.Fatal(err)
+		}
+
+		checkEquivalence(t, g, func(g *Graph) {
+			if err := pm.Run(g); err != nil {
+				t.Error(err)
+			}
+		})
+
+		// Node counts of the reports chain from one pass to the next
+		numNodes := -1
+		for _, report := range pm.Reports() {
+			if numNodes >= 0 && report.NumNodesBefore != numNodes {
+				t.Errorf("-O%d: %s starts with %d nodes, the previous pass ended with %d",
+					level, report.Name, report.NumNodesBefore, numNodes)
+			}
+			numNodes = report.NumNodesAfter
+		}
+		if numNodes >= 0 && numNodes != g.NumAllNodes() {
+			t.Errorf("-O%d: got %d nodes in the last report, want %d", level, numNodes, g.NumAllNodes())
+		}
+
+		// Only -O3 runs the e-graph optimizer
+		ranEGraph := false
+		for _, report := range pm.Reports() {
+			ranEGraph = ranEGraph || report.Name == "egraph"
+		}
+		if ranEGraph != (level == 3) {
+			t.Errorf("-O%d: got egraph run %v, want %v", level, ranEGraph, level == 3)
+		}
+	}
+}
+
+func TestDefaultPipeline(t *testing.T) {
+	tests := []struct {
+		assignments []string
+		// Operations and depth left by simplify, cse, balance and dce as
+		// BuildGraph ran them before optimization levels were added
+		oldNumOps, oldDepth int
+		numOps, depth       int
+	}{
+		{[]string{"y[0] = x[0]*x[1] + x[1]*x[0] + x[2]"}, 4, 4, 3, 4},
+		{[]string{"y[0] = sin(x[0])*cos(x[1]) + x[2]*x[3]*x[4]*x[5]", "y[1] = sin(x[0])*cos(x[1]) - x[2]"},
+			8, 5, 8, 4},
+		{[]string{"y[0] = (x[0] + 0)*1 + x[1]*x[2]*x[3]"}, 4, 5, 3, 4},
+		{[]string{"y[0] = x[0] - x[0] + x[1]*x[2]"}, 3, 4, 1, 2},
+		{[]string{"y[0] = power(x[0], 2)*x[1] + power(x[0], 2)*x[2]"}, 4, 4, 4, 4},
+		{[]string{"y[0] = x[0]*x[1]*x[2] + x[3]", "y[1] = x[0]*x[1]*x[4] - x[3]"}, 5, 4, 5, 4},
+		{[]string{"y[0] = x[0] + x[1] + x[2] + x[3] + x[4] + x[5] + x[6] + x[7]"}, 7, 4, 7, 4},
+	}
+
+	for _, test := range tests {
+		g := buildTestGraph(t, test.assignments...)
+
+		pm := CreatePassManager(PassOptions{})
+		checkEquivalence(t, g, func(g *Graph) {
+			if err := pm.Run(g); err != nil {
+				t.Error(err)
+			}
+		})
+
+		// The default build never gets worse than it was
+		numOps, depth := g.NumOperationNodes(), g.Levelize()
+		if numOps != test.numOps || depth != test.depth {
+			t.Errorf("%v: got %d operations and depth %d, want %d and %d",
+				test.assignments, numOps, depth, test.numOps, test.depth)
+		}
+		if numOps > test.oldNumOps || depth > test.oldDepth {
+			t.Errorf("%v: got %d operations and depth %d, %d and %d before optimization levels",
+				test.assignments, numOps, depth, test.oldNumOps, test.oldDepth)
+		}
+	}
+}
+
+// breakingPass is a pass that turns additions into multiplications
+type breakingPass struct{}
+
+func (p breakingPass) Name() string { return "breaking" }
+
+func (p breakingPass) Run(g *Graph) (int, error) {
+	for _, node := range g.operationNodes {
+		if node.op == NodeOp_Add {
+			node.op = NodeOp_Mul
+		}
+	}
+	return 0, nil
+}
+
+func TestPassManagerVerify(t *testing.T) {
+	g := buildTestGraph(t, "y[0] = x[0] + x[1] + 0")
+
+	after := &countingPass{}
+
+	pm := CreatePassManager(PassOptions{})
+	if err := pm.SetPipeline("simplify"); err != nil {
+		t.Fatal(err)
+	}
+	pm.groups = append(pm.groups, []Pass{breakingPass{}}, []Pass{after})
+	pm.fixedPoint = append(pm.fixedPoint, false, false)
+	pm.Verify(true, DefaultEvalOptions())
+
+	// The pipeline stops at the pass changing the outputs
+	err := pm.Run(g)
+	if err == nil || !strings.Contains(err.Error(), "pass breaking") {
+		t.Errorf("got error %v, want one naming the breaking pass", err)
+	}
+	if after.numRuns != 0 {
+		t.Errorf("a pass after the breaking pass ran")
+	}
+	if n := len(pm.Reports()); n != 2 {
+		t.Errorf("got %d reports, want 2", n)
+	}
+}
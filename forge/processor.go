@@ -15,6 +15,21 @@ const (
 
 var compatibleMap = make(map[NodeOp][][]int)
 
+/*
+nodeOpLatency is the number of cycles a process element takes to finish an
+operation.
+*/
+var nodeOpLatency = map[NodeOp]int{
+	NodeOp_Add:    1,
+	NodeOp_Mul:    2,
+	NodeOp_Power:  2,
+	NodeOp_Div:    3,
+	NodeOp_Sqrt:   3,
+	NodeOp_Sin:    3,
+	NodeOp_Cos:    3,
+	NodeOp_SinCos: 3,
+}
+
 // -----------------------------------------------------------------------------
 
 type ProcessElement struct {
@@ -152,7 +167,7 @@ func (p *Processor) AddProcessGroup(pg *ProcessGroup) {
 	pgId := len(p.processGroups)
 	p.processGroups = append(p.processGroups, pg)
 
-	for _, op := range NodeOpLUT {
+	for op := range NodeOpStringLUT {
 		compatibleMap[op] = append(compatibleMap[op], make([]int, 0))
 	}
 
@@ -175,9 +190,25 @@ func (p *Processor) AddProcessGroup(pg *ProcessGroup) {
 			{
 				compatibleMap[NodeOp_Sin][pgId] = append(compatibleMap[NodeOp_Sin][pgId], peId)
 				compatibleMap[NodeOp_Cos][pgId] = append(compatibleMap[NodeOp_Cos][pgId], peId)
+				compatibleMap[NodeOp_Sqrt][pgId] = append(compatibleMap[NodeOp_Sqrt][pgId], peId)
+				compatibleMap[NodeOp_SinCos][pgId] = append(compatibleMap[NodeOp_SinCos][pgId], peId)
 			}
 		default:
 			fmt.Printf("ERROR")
 		}
 	}
 }
+
+/*
+Supports checks if any process element of the processor can process the
+operation.
+*/
+func (p *Processor) Supports(op NodeOp) bool {
+	for pgId := range p.processGroups {
+		if pgId < len(compatibleMap[op]) && len(compatibleMap[op][pgId]) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
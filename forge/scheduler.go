@@ -10,12 +10,23 @@ type Scheduler struct {
 	mergedGraph *Graph
 
 	processor *Processor
+
+	// Graphs share input and constant nodes, see Graph.MergeShared()
+	shareInputs bool
+	// This maps an external node at a process group (name@pgId) to the time it
+	// is loaded. It's kept across graphs that share inputs so that shared inputs
+	// are loaded once.
+	inputMap map[string]int
 }
 
 /*
 ScheduleHeuristic schedules nodes onto the hardware heuristically.
 */
 func (s *Scheduler) ScheduleHeuristic() {
+	// Sub-graph priorities below depend on node levels, make sure they are
+	// up to date after graph transformations.
+	s.graph.Levelize()
+
 	// This maps the name of an external node (input or constant) to an identification
 	// number for quick search and comparison.
 	extNodeIds := make(map[string]int)
@@ -70,7 +81,9 @@ func (s *Scheduler) ScheduleHeuristic() {
 							// fanin is a not yet traversed external nodes.
 
 							traversedExtNodes[fanin.name] = true
-							sumExtNodeFanouts += fanin.NumFanouts()
+							// Shared external nodes also fan out to other graphs, only
+							// fanouts in this graph are counted
+							sumExtNodeFanouts += s.graph.numLocalFanouts(fanin)
 
 							rootExtNodes[node.name][extNodeIds[fanin.name]] = true
 						}
@@ -107,7 +120,10 @@ func (s *Scheduler) ScheduleHeuristic() {
 
 	//fmt.Println(" Scheduling the graph ...")
 
-	inputMap := make(map[string]int)
+	if s.inputMap == nil || !s.shareInputs {
+		s.inputMap = make(map[string]int)
+	}
+	inputMap := s.inputMap
 
 	costTblScheduleTime := make([][]int, len(s.processor.processGroups))
 	for pgId, pg := range s.processor.processGroups {
@@ -158,6 +174,20 @@ func (s *Scheduler) ScheduleHeuristic() {
 					}
 				}
 
+				// Selecting an output of a multi-output operation takes no time and
+				// needs no process element, it's available where the operation is.
+				if n.op == NodeOp_SinCosSin || n.op == NodeOp_SinCosCos {
+					fanin := n.Fanin(0)
+
+					n.isScheduled = true
+					n.pgScheduled = fanin.pgScheduled
+					n.peScheduled = fanin.peScheduled
+					n.startTime = fanin.finishTime
+					n.finishTime = fanin.finishTime
+
+					return
+				}
+
 				// Initialize cost table for schedule time.
 				for pgId, pg := range s.processor.processGroups {
 					for peId, _ := range pg.processElements {
@@ -272,16 +302,9 @@ func (s *Scheduler) ScheduleHeuristic() {
 				n.pgScheduled = bestPGId
 				n.peScheduled = bestPEId
 				n.startTime = scheduleTime
-				switch n.op {
-				case NodeOp_Add:
-					n.finishTime = scheduleTime + 1
-				case NodeOp_Mul, NodeOp_Power:
-					n.finishTime = scheduleTime + 2
-				case NodeOp_Div:
-					n.finishTime = scheduleTime + 3
-				case NodeOp_Sin, NodeOp_Cos:
-					n.finishTime = scheduleTime + 3
-				default:
+				if latency, exist := nodeOpLatency[n.op]; exist {
+					n.finishTime = scheduleTime + latency
+				} else {
 					fmt.Printf("ERROR: %s has unsupported operation %d\n", n.name, n.op)
 				}
 
@@ -1,28 +1,213 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cwhliu/sica-compiler/forge"
 )
 
 func main() {
+	statsFile := flag.String("stats", "", "write graph statistics in JSON format to `file`")
+	sharedInputs := flag.String("shared-inputs", "",
+		"comma-separated `variables` whose inputs are shared across files")
+	selectedOutputs := flag.String("outputs", "",
+		"comma-separated array `indices` of the outputs to compile, default all")
+	optLevel := flag.Int("O", forge.DefaultOptLevel, "optimization `level` from 0 to 3")
+	passes := flag.String("passes", "",
+		"comma-separated optimization `passes` overriding -O, passes in parentheses are iterated until nothing changes")
+	timePasses := flag.Bool("time-passes", false, "print the timing and node count change of each pass")
+	maxReassociationError := flag.Float64("max-reassoc-error", 0,
+		"keep sums whose reassociation may have a larger relative `error` unbalanced, and report output errors")
+	crossKernelCSE := flag.Bool("cross-kernel-cse", false,
+		"share inputs by name across files and eliminate common subexpressions between them")
+	rulesFile := flag.String("rules", "", "apply user-defined rewrite rules in `file` in the rewrite pass")
+	eGraphBudget := flag.Int("egraph-budget", forge.DefaultEGraphNodeBudget,
+		"maximum `number` of e-nodes of the egraph pass")
+	hashConsing := flag.Bool("hash-consing", false,
+		"build repeated operations on the same operands once while parsing")
+	fastMath := flag.Bool("fast-math", false,
+		"allow transformations that change floating point results slightly")
+
+	defaultEval := forge.DefaultEvalOptions()
+	verify := flag.Bool("verify", false,
+		"check that the outputs stay the same for random inputs after every optimization pass")
+	verifySeed := flag.Int64("verify-seed", defaultEval.Seed, "random `seed` of verification inputs")
+	verifySamples := flag.Int("verify-samples", defaultEval.NumSets, "`number` of verification input sets")
+	verifyDist := flag.String("verify-dist", "uniform",
+		"`distribution` of verification inputs: uniform, normal or loguniform")
+	verifyLow := flag.Float64("verify-low", defaultEval.Low, "lower bound of verification inputs")
+	verifyHigh := flag.Float64("verify-high", defaultEval.High, "upper bound of verification inputs")
+	verifyULP := flag.Uint64("verify-ulp", defaultEval.MaxULP, "maximum difference in `ulps` of a matching output")
+	verifyRel := flag.Float64("verify-rel", defaultEval.RelTolerance, "maximum relative difference of a matching output")
+	verifyAbs := flag.Float64("verify-abs", defaultEval.AbsTolerance, "maximum absolute difference of a matching output")
+	flag.Parse()
+
 	f := forge.Forge{}
 
-	if len(os.Args) == 2 {
-		f.BuildGraph(os.Args[1], "")
+	f.FastMath(*fastMath)
+	f.HashConsing(*hashConsing)
+	f.CrossKernelCSE(*crossKernelCSE)
+	f.LimitReassociationError(*maxReassociationError)
+	f.EGraphNodeBudget(*eGraphBudget)
+
+	distribution, ok := forge.InputDistributionLUT[*verifyDist]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "invalid input distribution", *verifyDist)
+		os.Exit(1)
+	}
+
+	f.Verify(*verify, forge.EvalOptions{
+		Seed:         *verifySeed,
+		NumSets:      *verifySamples,
+		Distribution: distribution,
+		Low:          *verifyLow,
+		High:         *verifyHigh,
+		MaxULP:       *verifyULP,
+		RelTolerance: *verifyRel,
+		AbsTolerance: *verifyAbs,
+	})
+
+	if *rulesFile != "" {
+		if err := f.LoadRewriteRules(*rulesFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	err := f.SetOptLevel(*optLevel)
+	if err == nil && *passes != "" {
+		err = f.SetPipeline(*passes)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *selectedOutputs != "" {
+		indices := []int{}
+		for _, field := range strings.Split(*selectedOutputs, ",") {
+			index, err := strconv.Atoi(field)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "invalid output index", field)
+				os.Exit(1)
+			}
+			indices = append(indices, index)
+		}
+
+		f.SelectOutputs(indices)
+	}
+
+	if *sharedInputs != "" {
+		f.ShareInputs(strings.Split(*sharedInputs, ","))
+	}
+
+	// buildGraph builds a graph and prints its report
+	buildGraph := func(filename, postfix string) {
+		report, err := f.BuildGraph(filename, postfix)
+		if report != nil {
+			if *hashConsing {
+				fmt.Printf("  %d repeated operations are shared\n", report.NumSharedOperations)
+			}
+			printBuildReport(report, *timePasses)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if flag.NArg() == 1 {
+		buildGraph(flag.Arg(0), "")
 		f.ScheduleGraph()
-	} else if len(os.Args) > 2 {
-		for g := 1; g < len(os.Args); g++ {
-			f.BuildGraph(os.Args[g], strconv.FormatInt(int64(g), 10))
+	} else if flag.NArg() > 1 {
+		for g := 1; g <= flag.NArg(); g++ {
+			buildGraph(flag.Arg(g-1), strconv.FormatInt(int64(g), 10))
+			// The merged graph is scheduled as a whole after cross-kernel elimination
+			if !*crossKernelCSE {
+				f.ScheduleGraph()
+			}
+		}
+
+		if *crossKernelCSE {
+			fmt.Printf("  %d operations are eliminated across files\n", f.EliminateCrossKernelRedundancy())
 			f.ScheduleGraph()
 		}
 	} else {
-		fmt.Printf("\nUsage: %s file_name [file_names]\n\n", os.Args[0])
+		fmt.Printf("\nUsage: %s [options] file_name [file_names]\n\n", os.Args[0])
+		flag.PrintDefaults()
 		return
 	}
 
 	f.Output()
+
+	if *statsFile != "" {
+		data, err := json.MarshalIndent(f.Stats(), "", "  ")
+		if err == nil {
+			err = os.WriteFile(*statsFile, data, 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+/*
+printBuildReport prints the messages and rule applications of the passes and the
+output errors of a built graph, and the timing and node count change of each
+pass if timePasses is true.
+*/
+func printBuildReport(report *forge.BuildReport, timePasses bool) {
+	if timePasses {
+		fmt.Printf("  Passes for %s\n", report.Filename)
+		fmt.Printf("  %-16s %12s %10s %8s %8s\n", "pass", "time", "nodes", "delta", "changes")
+
+		var total time.Duration
+		for _, pass := range report.Passes {
+			fmt.Printf("  %-16s %12s %10d %8d %8d\n", pass.Name, pass.Duration,
+				pass.NumNodesAfter, pass.NumNodesAfter-pass.NumNodesBefore, pass.NumChanges)
+
+			total += pass.Duration
+		}
+
+		fmt.Printf("  %-16s %12s\n", "total", total)
+	}
+
+	for _, pass := range report.Passes {
+		for _, message := range pass.Messages {
+			fmt.Printf("  %s: %s\n", pass.Name, message)
+		}
+
+		for _, rule := range pass.Rules {
+			if rule.NumFired > 0 {
+				fmt.Printf("  rule %s is applied to %d nodes\n", rule.Name, rule.NumFired)
+			}
+			if rule.NumRejected > 0 {
+				fmt.Printf("  rule %s is rejected at %d nodes by sampling\n", rule.Name, rule.NumRejected)
+			}
+		}
+	}
+	for _, warning := range report.Warnings {
+		fmt.Printf("  warning: %s\n", warning)
+	}
+
+	if len(report.OutputErrors) > 0 {
+		names := []string{}
+		for name := range report.OutputErrors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Printf("  Worst relative error of each output in %s\n", report.Filename)
+		for _, name := range names {
+			fmt.Printf("    %-16s %.3g\n", name, report.OutputErrors[name])
+		}
+	}
 }